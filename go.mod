@@ -7,8 +7,11 @@ toolchain go1.24.2
 require (
 	github.com/go-jose/go-jose/v4 v4.1.0
 	github.com/hashicorp/vault-client-go v0.4.3
+	github.com/miekg/pkcs11 v1.1.2
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.19.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -36,5 +39,4 @@ require (
 	golang.org/x/text v0.19.0 // indirect
 	golang.org/x/time v0.8.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
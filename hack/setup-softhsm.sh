@@ -0,0 +1,28 @@
+#!/bin/bash
+set -e
+
+# creates a SoftHSM token for testing the PKCS#11 key backend locally
+
+TOKEN_LABEL=${TOKEN_LABEL:-cpidp}
+PIN=${PIN:-1234}
+SO_PIN=${SO_PIN:-5678}
+
+if ! command -v softhsm2-util > /dev/null; then
+    echo softhsm2-util must be installed
+    exit 1
+fi
+
+if [ -z $SOFTHSM2_CONF ]; then
+    export SOFTHSM2_CONF=$PWD/softhsm2.conf
+    mkdir -p $PWD/softhsm-tokens
+    echo "directories.tokendir = $PWD/softhsm-tokens" > $SOFTHSM2_CONF
+    echo Created $SOFTHSM2_CONF, export SOFTHSM2_CONF=$SOFTHSM2_CONF before starting concourse-pipeline-idp
+fi
+
+if softhsm2-util --show-slots | grep -q "Label:.*$TOKEN_LABEL"; then
+    echo Token $TOKEN_LABEL already exists
+    exit 0
+fi
+
+echo Initializing token $TOKEN_LABEL
+softhsm2-util --init-token --free --label "$TOKEN_LABEL" --pin "$PIN" --so-pin "$SO_PIN"
@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// AdminAPI exposes manual key operations and the key history via HTTP. Requests must be authenticated with the admin-token.
+// Key operations are only accepted by the current leader, so that all modifications are done by the instance managing the keys.
+type AdminAPI struct {
+	// KeyManagers are the managers of all key rings
+	KeyManagers []*KeyManager
+	// Storage is read for the key history
+	Storage Storage
+	Token   string
+
+	leader atomic.Bool
+}
+
+type adminResponse struct {
+	Message string `json:"message"`
+}
+
+// SetLeader marks this instance as (no longer) being the leader
+func (a *AdminAPI) SetLeader(leader bool) {
+	a.leader.Store(leader)
+}
+
+// Register registers the admin endpoints on the given mux
+func (a *AdminAPI) Register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /admin/keys/rotate", a.guard(a.rotate))
+	mux.HandleFunc("POST /admin/keys/{kid}/retire", a.guard(a.retire))
+	mux.HandleFunc("POST /admin/keys/{kid}/revoke", a.guard(a.revoke))
+	mux.HandleFunc("POST /admin/keys/import", a.guard(a.importKey))
+	mux.HandleFunc("GET /admin/keys/history", a.authenticate(a.history))
+	mux.HandleFunc("POST /admin/tokens/verify", a.authenticate(a.verify))
+}
+
+// importRequest is the body of requests to the import endpoint
+type importRequest struct {
+	JWK         jose.JSONWebKey `json:"jwk"`
+	PinnedUntil time.Time       `json:"pinnedUntil,omitzero"`
+}
+
+// verifyRequest is the body of requests to the verify endpoint
+type verifyRequest struct {
+	Token string `json:"token"`
+}
+
+// authenticate checks the admin-token before calling the handler
+func (a *AdminAPI) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+// guard checks authentication and leadership before calling the handler
+func (a *AdminAPI) guard(handler func(request *http.Request) (string, error)) http.HandlerFunc {
+	return a.authenticate(func(writer http.ResponseWriter, request *http.Request) {
+		if !a.leader.Load() {
+			http.Error(writer, "this instance is not the leader", http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Printf("Admin request from %s: %s %s", request.RemoteAddr, request.Method, request.URL.Path)
+		message, err := handler(request)
+		if err != nil {
+			log.Printf("Admin request %s %s failed: %s", request.Method, request.URL.Path, err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyRingNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(writer, err.Error(), status)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(adminResponse{Message: message})
+	})
+}
+
+// keyManager returns the manager of the key ring selected by the keyRing query-parameter
+func (a *AdminAPI) keyManager(request *http.Request) (*KeyManager, error) {
+	keyRing := request.URL.Query().Get("keyRing")
+	for _, keyManager := range a.KeyManagers {
+		if keyManager.KeyRing == keyRing {
+			return keyManager, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrKeyRingNotFound, keyRing)
+}
+
+// forKey calls operation with the manager of every key ring, until one of them does not return ErrKeyNotFound
+func (a *AdminAPI) forKey(operation func(keyManager *KeyManager) error) error {
+	for _, keyManager := range a.KeyManagers {
+		err := operation(keyManager)
+		if !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+	}
+	return ErrKeyNotFound
+}
+
+func (a *AdminAPI) rotate(request *http.Request) (string, error) {
+	keyManager, err := a.keyManager(request)
+	if err != nil {
+		return "", err
+	}
+	algorithm := request.URL.Query().Get("algorithm")
+	err = keyManager.Rotate(request.Context(), algorithm)
+	if err != nil {
+		return "", err
+	}
+	if algorithm == "" {
+		return "rotated the signing keys for all algorithms", nil
+	}
+	return "rotated the signing key for " + algorithm, nil
+}
+
+func (a *AdminAPI) retire(request *http.Request) (string, error) {
+	kid := request.PathValue("kid")
+	err := a.forKey(func(keyManager *KeyManager) error {
+		return keyManager.Retire(request.Context(), kid)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "retired signing key " + kid, nil
+}
+
+func (a *AdminAPI) revoke(request *http.Request) (string, error) {
+	kid := request.PathValue("kid")
+	err := a.forKey(func(keyManager *KeyManager) error {
+		return keyManager.Revoke(request.Context(), kid)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "revoked signing key " + kid, nil
+}
+
+func (a *AdminAPI) importKey(request *http.Request) (string, error) {
+	keyManager, err := a.keyManager(request)
+	if err != nil {
+		return "", err
+	}
+	var body importRequest
+	err = json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("invalid request body: %w", err)
+	}
+	err = keyManager.Import(request.Context(), body.JWK, body.PinnedUntil)
+	if err != nil {
+		return "", err
+	}
+	return "imported signing key " + body.JWK.KeyID, nil
+}
+
+// history serves the histories of all keys, or of the key selected by the kid query-parameter
+func (a *AdminAPI) history(writer http.ResponseWriter, request *http.Request) {
+	var histories []KeyHistory
+	var err error
+	if kid := request.URL.Query().Get("kid"); kid != "" {
+		if err := ValidateKeyID(kid); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var history KeyHistory
+		history, err = a.Storage.GetKeyHistory(request.Context(), kid)
+		histories = []KeyHistory{history}
+	} else {
+		histories, err = LoadKeyHistories(request.Context(), a.Storage)
+	}
+	if errors.Is(err, ErrKeyHistoryNotFound) {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(histories)
+}
+
+// verify verifies the token in the request body against the key history
+func (a *AdminAPI) verify(writer http.ResponseWriter, request *http.Request) {
+	var body verifyRequest
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	result, err := VerifyWithKeyHistory(request.Context(), a.Storage, body.Token)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(result)
+}
+
+// AdminClient calls the AdminAPI of a running instance
+type AdminClient struct {
+	URL   string
+	Token string
+}
+
+func (c AdminClient) Rotate(ctx context.Context, keyRing string, algorithm string) (string, error) {
+	query := url.Values{}
+	if keyRing != DefaultKeyRing {
+		query.Set("keyRing", keyRing)
+	}
+	if algorithm != "" {
+		query.Set("algorithm", algorithm)
+	}
+	return c.post(ctx, "/admin/keys/rotate?"+query.Encode(), nil)
+}
+
+func (c AdminClient) Retire(ctx context.Context, kid string) (string, error) {
+	return c.post(ctx, "/admin/keys/"+url.PathEscape(kid)+"/retire", nil)
+}
+
+func (c AdminClient) Revoke(ctx context.Context, kid string) (string, error) {
+	return c.post(ctx, "/admin/keys/"+url.PathEscape(kid)+"/revoke", nil)
+}
+
+// Import sends the private key to the admin api. Refuses to send it unencrypted, unless the admin api is reached via loopback.
+func (c AdminClient) Import(ctx context.Context, keyRing string, key jose.JSONWebKey, pinnedUntil time.Time) (string, error) {
+	if err := requireSecureURL(c.URL); err != nil {
+		return "", fmt.Errorf("refusing to send private key: %w", err)
+	}
+	query := url.Values{}
+	if keyRing != DefaultKeyRing {
+		query.Set("keyRing", keyRing)
+	}
+	return c.post(ctx, "/admin/keys/import?"+query.Encode(), importRequest{
+		JWK:         key,
+		PinnedUntil: pinnedUntil,
+	})
+}
+
+// requireSecureURL returns an error if rawURL is neither https nor points to a loopback address
+func requireSecureURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid admin url: %w", err)
+	}
+	if parsed.Scheme == "https" {
+		return nil
+	}
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("admin url %s must use https, unless it points to localhost", rawURL)
+}
+
+// post sends a request to the admin api. If body is not nil, it is sent as JSON
+func (c AdminClient) post(ctx context.Context, path string, body interface{}) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	var requestBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		requestBody = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.URL, "/")+path, requestBody)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("admin api responded with %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var response adminResponse
+	err = json.Unmarshal(respBody, &response)
+	if err != nil {
+		return "", err
+	}
+	return response.Message, nil
+}
@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// backupFormatVersion is increased on incompatible changes of the backup format
+const backupFormatVersion = 1
+
+// backupKeyAlgorithms are the key-management algorithms backups are encrypted with
+var backupKeyAlgorithms = []jose.KeyAlgorithm{jose.PBES2_HS512_A256KW, jose.RSA_OAEP_256, jose.ECDH_ES_A256KW}
+
+// backupContent is the plaintext of a backup
+type backupContent struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// KeyRings maps the storage location of each key ring to its keys
+	KeyRings map[string]KeySet `json:"keyRings"`
+}
+
+// KeyBackup exports the signing keys of all key rings, including their lifecycle metadata, into an encrypted file and restores them.
+// Backups are encrypted as JWE, either with a passphrase or for a recipient's RSA or EC public key. The authenticated encryption
+// guarantees the integrity of the backup.
+type KeyBackup struct {
+	Storage Storage
+	// KeyLocations are the storage locations of all key rings
+	KeyLocations []string
+	// Passphrase to encrypt or decrypt the backup with. Takes precedence over Key
+	Passphrase string
+	// Key is the public key to encrypt the backup for, or the private key to decrypt it with
+	Key interface{}
+	// Force allows restoring over keys that are newer than the backup
+	Force bool
+}
+
+// Backup reads the keys of all key rings and returns them as encrypted backup
+func (b KeyBackup) Backup(ctx context.Context) ([]byte, error) {
+	content := backupContent{
+		Version:  backupFormatVersion,
+		Created:  time.Now(),
+		KeyRings: make(map[string]KeySet, len(b.KeyLocations)),
+	}
+	for _, location := range b.KeyLocations {
+		keys, _, err := b.Storage.GetKeys(ctx, location)
+		if err != nil && err != ErrNoKeysFound {
+			return nil, fmt.Errorf("error when reading keys at %s: %w", location, err)
+		}
+		if len(keys) == 0 {
+			log.Printf("No signing keys found at %s, skipping", location)
+			continue
+		}
+		log.Printf("Backing up %d signing keys at %s", len(keys), location)
+		content.KeyRings[location] = keys
+	}
+	if len(content.KeyRings) == 0 {
+		return nil, ErrNoKeysFound
+	}
+
+	plaintext, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := b.recipient()
+	if err != nil {
+		return nil, err
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, recipient, (&jose.EncrypterOptions{}).WithContentType("cpidp-backup+json"))
+	if err != nil {
+		return nil, fmt.Errorf("error when creating encrypter: %w", err)
+	}
+	encrypted, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("error when encrypting backup: %w", err)
+	}
+	serialized, err := encrypted.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(serialized), nil
+}
+
+func (b KeyBackup) recipient() (jose.Recipient, error) {
+	if b.Passphrase != "" {
+		return jose.Recipient{Algorithm: jose.PBES2_HS512_A256KW, Key: b.Passphrase}, nil
+	}
+	switch key := b.Key.(type) {
+	case *rsa.PublicKey:
+		return jose.Recipient{Algorithm: jose.RSA_OAEP_256, Key: key}, nil
+	case *ecdsa.PublicKey:
+		return jose.Recipient{Algorithm: jose.ECDH_ES_A256KW, Key: key}, nil
+	case nil:
+		return jose.Recipient{}, fmt.Errorf("a passphrase or the public key of a recipient is required")
+	}
+	return jose.Recipient{}, fmt.Errorf("recipient key must be an RSA or EC public key, got %T", b.Key)
+}
+
+// Restore decrypts and validates the backup and stores its keys. Refuses to overwrite keys that have been created, retired or removed
+// after the backup, and to restore keys that have been revoked, unless Force is set.
+func (b KeyBackup) Restore(ctx context.Context, data []byte) error {
+	content, err := b.decrypt(data)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restoring backup created at %s", content.Created)
+
+	// check all key rings before writing anything, so a refused restore does not leave a partially restored state
+	versions := make(map[string]int64, len(content.KeyRings))
+	for location, keys := range content.KeyRings {
+		if !slices.Contains(b.KeyLocations, location) {
+			log.Printf("Backup contains keys for %s, which is not a configured key ring. Restoring anyway", location)
+		}
+		existing, version, err := b.Storage.GetKeys(ctx, location)
+		if err != nil && err != ErrNoKeysFound {
+			return fmt.Errorf("error when reading keys at %s: %w", location, err)
+		}
+		newer := newerKeys(existing, keys, content.Created)
+		if len(newer) > 0 {
+			if !b.Force {
+				return fmt.Errorf("%s contains keys %v that are newer than the backup, refusing to overwrite them", location, newer)
+			}
+			log.Printf("Overwriting keys %v at %s that are newer than the backup", newer, location)
+		}
+		advanced := advancedKeys(existing, keys)
+		if len(advanced) > 0 {
+			if !b.Force {
+				return fmt.Errorf("keys %v at %s have been retired or removed after the backup, refusing to undo this", advanced, location)
+			}
+			log.Printf("Undoing the retirement or removal of keys %v at %s", advanced, location)
+		}
+		revoked, err := revokedKeys(ctx, b.Storage, keys)
+		if err != nil {
+			return err
+		}
+		if len(revoked) > 0 {
+			if !b.Force {
+				return fmt.Errorf("backup contains keys %v at %s that have been revoked, refusing to restore them", revoked, location)
+			}
+			log.Printf("Restoring keys %v at %s that have been revoked", revoked, location)
+		}
+		versions[location] = version
+	}
+
+	for location, keys := range content.KeyRings {
+		err = b.Storage.StoreKeys(ctx, location, keys, versions[location])
+		if err != nil {
+			return fmt.Errorf("error when storing keys at %s: %w", location, err)
+		}
+		log.Printf("Restored %d signing keys at %s", len(keys), location)
+	}
+	return nil
+}
+
+func (b KeyBackup) decrypt(data []byte) (backupContent, error) {
+	encrypted, err := jose.ParseEncrypted(string(data), backupKeyAlgorithms, []jose.ContentEncryption{jose.A256GCM})
+	if err != nil {
+		return backupContent{}, fmt.Errorf("file is not a valid backup: %w", err)
+	}
+
+	var key interface{} = b.Passphrase
+	if b.Passphrase == "" {
+		key = b.Key
+	}
+	if key == nil {
+		return backupContent{}, fmt.Errorf("a passphrase or a private key is required")
+	}
+	plaintext, err := encrypted.Decrypt(key)
+	if err != nil {
+		return backupContent{}, fmt.Errorf("error when decrypting backup, the key is wrong or the backup has been modified: %w", err)
+	}
+
+	var content backupContent
+	err = json.Unmarshal(plaintext, &content)
+	if err != nil {
+		return backupContent{}, fmt.Errorf("backup is corrupt: %w", err)
+	}
+	if content.Version != backupFormatVersion {
+		return backupContent{}, fmt.Errorf("unsupported backup format version %d", content.Version)
+	}
+	for location, keys := range content.KeyRings {
+		if err := validateBackupKeys(keys); err != nil {
+			return backupContent{}, fmt.Errorf("backup contains invalid keys at %s: %w", location, err)
+		}
+	}
+	return content, nil
+}
+
+// validateBackupKeys checks that all keys are valid and have unique key-ids. Keys whose private key is held by a KeyBackend
+// only contain their public key.
+func validateBackupKeys(keys KeySet) error {
+	kids := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !key.JWK.Valid() {
+			return fmt.Errorf("key %s is not a valid key", key.JWK.KeyID)
+		}
+		if kids[key.JWK.KeyID] {
+			return fmt.Errorf("duplicate key %s", key.JWK.KeyID)
+		}
+		kids[key.JWK.KeyID] = true
+	}
+	return nil
+}
+
+// newerKeys returns the key-ids of existing keys that are not part of the backup and have been created after it
+func newerKeys(existing KeySet, backup KeySet, backupCreated time.Time) []string {
+	newer := make([]string, 0)
+	for _, key := range existing {
+		inBackup := slices.ContainsFunc(backup, func(backupKey ManagedKey) bool { return backupKey.JWK.KeyID == key.JWK.KeyID })
+		if !inBackup && key.Lifecycle.Created.After(backupCreated) {
+			newer = append(newer, key.JWK.KeyID)
+		}
+	}
+	return newer
+}
+
+// advancedKeys returns the key-ids of keys in both keysets that have been retired or removed after the backup,
+// or are scheduled to be retired or removed earlier than in the backup
+func advancedKeys(existing KeySet, backup KeySet) []string {
+	advanced := make([]string, 0)
+	for _, key := range existing {
+		i := slices.IndexFunc(backup, func(backupKey ManagedKey) bool { return backupKey.JWK.KeyID == key.JWK.KeyID })
+		if i == -1 {
+			continue
+		}
+		if earlier(key.Lifecycle.Retired, backup[i].Lifecycle.Retired) || earlier(key.Lifecycle.Removed, backup[i].Lifecycle.Removed) {
+			advanced = append(advanced, key.JWK.KeyID)
+		}
+	}
+	return advanced
+}
+
+// earlier returns whether the transition at t happens before the one at other. Zero times never happen.
+func earlier(t time.Time, other time.Time) bool {
+	return !t.IsZero() && (other.IsZero() || t.Before(other))
+}
+
+// revokedKeys returns the key-ids of the keys whose history contains a revocation
+func revokedKeys(ctx context.Context, store Storage, keys KeySet) ([]string, error) {
+	revoked := make([]string, 0)
+	for _, key := range keys {
+		history, err := store.GetKeyHistory(ctx, key.JWK.KeyID)
+		if err == ErrKeyHistoryNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error when reading history of key %s: %w", key.JWK.KeyID, err)
+		}
+		if !history.lastEvent(KeyRevoked).IsZero() {
+			revoked = append(revoked, key.JWK.KeyID)
+		}
+	}
+	return revoked, nil
+}
+
+// ParseBackupKey parses the key used to encrypt or decrypt backups. Accepts public or private keys in PEM or JWK format.
+func ParseBackupKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		var key jose.JSONWebKey
+		err := json.Unmarshal(data, &key)
+		if err != nil {
+			return nil, fmt.Errorf("key is neither PEM nor JWK: %w", err)
+		}
+		return key.Key, nil
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return parsePEMPrivateKey(block)
+	}
+}
@@ -2,11 +2,17 @@ package internal
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/go-jose/go-jose/v4"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
@@ -16,7 +22,21 @@ type Config struct {
 	VaultOpts          VaultOpts
 	LeaderElectionOpts LeaderElectionOpts
 	KeyOpts            KeyOpts
+	PKCS11Opts         PKCS11Opts
+	MigrateOpts        MigrateOpts
+	HealthOpts         HealthOpts
+	AdminOpts          AdminOpts
+	ImportOpts         ImportOpts
+	BackupOpts         BackupOpts
+	SubjectOpts        SubjectOpts
 	Tokens             []TokenConfig
+	// Claims are added to all tokens, unless a token config overrides them
+	Claims map[string]interface{}
+	// ClaimVariables are available in the templates of custom claims
+	ClaimVariables map[string]string
+	Webhooks       []WebhookConfig
+	Hooks          []HookConfig
+	KeyRings       []KeyRingConfig
 }
 
 type VaultOpts struct {
@@ -30,7 +50,56 @@ type VaultOpts struct {
 
 type KeyOpts struct {
 	RotationPeriod time.Duration
-	MaxAge         time.Duration
+	// RotationSchedule is a cron expression that limits when keys are rotated
+	RotationSchedule string
+	MaxAge           time.Duration
+	PrePublish       time.Duration
+	Algorithm        string
+	Algorithms       []string
+	RSABits          int
+	// ReissueOnRotation reissues all tokens signed by the previous key, spread over ReissueWindow, once a new key becomes active
+	ReissueOnRotation bool
+	ReissueWindow     time.Duration
+	// Certificates publishes an X.509 certificate for every key, issued by the CA in CACert and CAKey or self-signed
+	Certificates bool
+	CACert       string
+	CAKey        string
+	// Backend is the KeyBackend holding the private keys
+	Backend string
+}
+
+type PKCS11Opts struct {
+	Module     string
+	TokenLabel string
+	Pin        string
+}
+
+type AdminOpts struct {
+	Token   string
+	URL     string
+	KeyRing string
+}
+
+type ImportOpts struct {
+	Algorithm   string
+	PinnedUntil string
+}
+
+type BackupOpts struct {
+	Passphrase string
+	KeyFile    string
+	Force      bool
+}
+
+type HealthOpts struct {
+	Interval time.Duration
+}
+
+type MigrateOpts struct {
+	Destination string
+	Tokens      bool
+	DryRun      bool
+	Force       bool
 }
 
 type LeaderElectionOpts struct {
@@ -58,7 +127,44 @@ func LoadConfig() (Config, error) {
 	flag.Duration("leaderElection.ttl", 1*time.Minute, "How long a leaderElection remains valid")
 
 	flag.Duration("key.rotationPeriod", 24*time.Hour, "Time after which a new signing key should be generated and used")
+	flag.String("key.rotationSchedule", "", "Cron expression of the times keys may be rotated at, e.g. '* 9-15 * * 1-5'. Rotations are moved to the next matching minute, but keys are never published beyond key.maxAge")
 	flag.Duration("key.maxAge", 48*time.Hour, "Time after which a key should be removed from the jwks")
+	flag.Duration("key.prePublishPeriod", 0, "Time a new key is published in the jwks before it is used for signing")
+	flag.String("key.algorithm", "RS256", "Default signing algorithm [RS256,RS384,RS512,PS256,ES256,ES384,EdDSA]")
+	flag.StringSlice("key.algorithms", []string{}, "Additional signing algorithms to maintain active keys for")
+	flag.Int("key.rsaBits", 4096, "Modulus size for new RSA keys")
+	flag.Bool("key.reissueOnRotation", false, "Reissue all tokens signed by the previous key once a new key becomes active")
+	flag.Duration("key.reissueWindow", 0, "Time over which the reissues after a rotation are spread. Defaults to a tenth of key.rotationPeriod")
+	flag.Bool("key.certificates", false, "Publish an X.509 certificate (x5c, x5t, x5t#S256) for every key in the jwks")
+	flag.String("key.caCert", "", "PEM file with the CA certificate to issue key certificates with. Certificates are self-signed if empty")
+	flag.String("key.caKey", "", "PEM file with the private key of the CA")
+	flag.String("key.backend", "memory", "Where to keep the private signing keys [memory,pkcs11]. memory stores them in the storage-backend")
+
+	flag.String("pkcs11.module", "", "Path of the PKCS#11 module to load (only for key.backend pkcs11)")
+	flag.String("pkcs11.tokenLabel", "", "Label of the PKCS#11 token to keep the keys on (only for key.backend pkcs11)")
+	flag.String("pkcs11.pin", "", "User PIN of the PKCS#11 token (only for key.backend pkcs11)")
+
+	flag.String("subject.format", "", "Default template or preset [spiffe] for the subject of tokens. If empty, the subject is built according to the subjectScope of the token")
+	flag.Int("subject.maxLength", 255, "Maximum length of the subject of tokens in bytes. 0 disables the limit")
+	flag.String("subject.trustDomain", "", "SPIFFE trust domain for the spiffe subject format. Defaults to the host of externalUrl")
+
+	flag.Duration("health.interval", 30*time.Second, "How often to check the health of the storage-backend")
+
+	flag.String("admin.token", "", "Token to authenticate requests to the admin api. The admin api is disabled if empty")
+	flag.String("admin.url", "http://localhost:8080", "URL of the instance to send admin commands to (only for the rotate, retire, revoke and import commands)")
+	flag.String("admin.keyRing", "", "Key ring to rotate or import into. Defaults to the default key ring (only for the rotate and import commands)")
+
+	flag.String("import.algorithm", "", "Algorithm of the imported key. Defaults to the alg of the JWK or the default algorithm of the key type (only for the import command)")
+	flag.String("import.pinUntil", "", "RFC 3339 timestamp until which the imported key must not be rotated (only for the import command)")
+
+	flag.String("backup.passphrase", "", "Passphrase to encrypt or decrypt the backup with (only for the backup and restore commands)")
+	flag.String("backup.keyFile", "", "Public key (PEM or JWK) to encrypt the backup for, or private key to decrypt it with (only for the backup and restore commands)")
+	flag.Bool("backup.force", false, "Overwrite signing keys that are newer than the backup (only for the restore command)")
+
+	flag.String("migrate.destination", "", "Config-file containing the backend-settings to migrate to (only for the migrate command)")
+	flag.Bool("migrate.tokens", false, "Also migrate the currently issued tokens (only for the migrate command)")
+	flag.Bool("migrate.dryRun", false, "Only print what would be migrated (only for the migrate command)")
+	flag.Bool("migrate.force", false, "Overwrite existing signing keys at the destination (only for the migrate command)")
 
 	flag.Parse()
 
@@ -80,32 +186,127 @@ func LoadConfig() (Config, error) {
 		ExternalURL: viper.GetString("externalUrl"),
 		ListenAddr:  viper.GetString("listenAddr"),
 		Backend:     viper.GetString("backend"),
-		VaultOpts: VaultOpts{
-			URL:           viper.GetString("vault.url"),
-			Token:         viper.GetString("vault.token"),
-			ApproleID:     viper.GetString("vault.approleId"),
-			ApproleSecret: viper.GetString("vault.approleSecret"),
-			ConcoursePath: viper.GetString("vault.concoursePath"),
-			ConfigPath:    viper.GetString("vault.configPath"),
-		},
+		VaultOpts:   loadVaultOpts(viper.GetViper()),
 		LeaderElectionOpts: LeaderElectionOpts{
 			Enabled: viper.GetBool("leaderElection.enabled"),
 			Name:    viper.GetString("leaderElection.name"),
 			TTL:     viper.GetDuration("leaderElection.ttl"),
 		},
 		KeyOpts: KeyOpts{
-			RotationPeriod: viper.GetDuration("key.rotationPeriod"),
-			MaxAge:         viper.GetDuration("key.maxAge"),
+			RotationPeriod:    viper.GetDuration("key.rotationPeriod"),
+			RotationSchedule:  viper.GetString("key.rotationSchedule"),
+			MaxAge:            viper.GetDuration("key.maxAge"),
+			PrePublish:        viper.GetDuration("key.prePublishPeriod"),
+			Algorithm:         viper.GetString("key.algorithm"),
+			Algorithms:        viper.GetStringSlice("key.algorithms"),
+			RSABits:           viper.GetInt("key.rsaBits"),
+			ReissueOnRotation: viper.GetBool("key.reissueOnRotation"),
+			ReissueWindow:     viper.GetDuration("key.reissueWindow"),
+			Certificates:      viper.GetBool("key.certificates"),
+			CACert:            viper.GetString("key.caCert"),
+			CAKey:             viper.GetString("key.caKey"),
+			Backend:           viper.GetString("key.backend"),
+		},
+		PKCS11Opts: PKCS11Opts{
+			Module:     viper.GetString("pkcs11.module"),
+			TokenLabel: viper.GetString("pkcs11.tokenLabel"),
+			Pin:        viper.GetString("pkcs11.pin"),
+		},
+		AdminOpts: AdminOpts{
+			Token:   viper.GetString("admin.token"),
+			URL:     viper.GetString("admin.url"),
+			KeyRing: viper.GetString("admin.keyRing"),
 		},
-		Tokens: []TokenConfig{},
+		ImportOpts: ImportOpts{
+			Algorithm:   viper.GetString("import.algorithm"),
+			PinnedUntil: viper.GetString("import.pinUntil"),
+		},
+		BackupOpts: BackupOpts{
+			Passphrase: viper.GetString("backup.passphrase"),
+			KeyFile:    viper.GetString("backup.keyFile"),
+			Force:      viper.GetBool("backup.force"),
+		},
+		SubjectOpts: SubjectOpts{
+			Format:      viper.GetString("subject.format"),
+			MaxLength:   viper.GetInt("subject.maxLength"),
+			TrustDomain: viper.GetString("subject.trustDomain"),
+		},
+		HealthOpts: HealthOpts{
+			Interval: viper.GetDuration("health.interval"),
+		},
+		MigrateOpts: MigrateOpts{
+			Destination: viper.GetString("migrate.destination"),
+			Tokens:      viper.GetBool("migrate.tokens"),
+			DryRun:      viper.GetBool("migrate.dryRun"),
+			Force:       viper.GetBool("migrate.force"),
+		},
+		Tokens:         []TokenConfig{},
+		Claims:         viper.GetStringMap("claims"),
+		ClaimVariables: viper.GetStringMapString("claimVariables"),
+		Webhooks:       []WebhookConfig{},
 	}
 	err = viper.UnmarshalKey("tokens", &cfg.Tokens)
 	if err != nil {
 		return Config{}, err
 	}
+	err = loadClaimNames(viper.GetViper(), &cfg)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// spread reissues after rotations by default, 0 must be set explicitly to reissue all tokens at once
+	if !viper.IsSet("key.reissueWindow") {
+		cfg.KeyOpts.ReissueWindow = cfg.KeyOpts.RotationPeriod / 10
+	}
+
+	// the default algorithm always comes first
+	algorithms := []string{cfg.KeyOpts.Algorithm}
+	for _, algorithm := range cfg.KeyOpts.Algorithms {
+		if !slices.Contains(algorithms, algorithm) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	cfg.KeyOpts.Algorithms = algorithms
+
+	err = viper.UnmarshalKey("keyRings", &cfg.KeyRings)
+	if err != nil {
+		return Config{}, err
+	}
+
+	for i := range cfg.KeyRings {
+		cfg.KeyRings[i].FillWithDefaults(cfg.KeyOpts)
+	}
+
+	if cfg.SubjectOpts.TrustDomain == "" {
+		if externalURL, err := url.Parse(cfg.ExternalURL); err == nil {
+			cfg.SubjectOpts.TrustDomain = strings.ToLower(externalURL.Hostname())
+		}
+	}
 
 	for i := range cfg.Tokens {
-		cfg.Tokens[i].FillWithDefaults()
+		cfg.Tokens[i].FillWithDefaults(cfg.SubjectOpts)
+		cfg.Tokens[i].Claims = mergeClaims(cfg.Claims, cfg.Tokens[i].Claims)
+		if cfg.Tokens[i].KeyRing == DefaultKeyRing {
+			cfg.Tokens[i].KeyRing = cfg.teamKeyRing(cfg.Tokens[i].Team)
+		}
+	}
+
+	err = viper.UnmarshalKey("webhooks", &cfg.Webhooks)
+	if err != nil {
+		return Config{}, err
+	}
+
+	for i := range cfg.Webhooks {
+		cfg.Webhooks[i].FillWithDefaults()
+	}
+
+	err = viper.UnmarshalKey("hooks", &cfg.Hooks)
+	if err != nil {
+		return Config{}, err
+	}
+
+	for i := range cfg.Hooks {
+		cfg.Hooks[i].FillWithDefaults()
 	}
 
 	if cfg.LeaderElectionOpts.Name == "" {
@@ -119,10 +320,313 @@ func LoadConfig() (Config, error) {
 	return cfg, nil
 }
 
+// LoadBackendConfig loads only the storage-backend settings from the given config-file
+func LoadBackendConfig(file string) (Config, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yaml")
+	v.SetDefault("backend", "vault")
+	v.SetDefault("vault.concoursePath", "/concourse")
+	v.SetDefault("vault.configPath", "/concourse/pipeline-idp")
+
+	err := v.ReadInConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Config{
+		Backend:   v.GetString("backend"),
+		VaultOpts: loadVaultOpts(v),
+	}, nil
+}
+
+// teamKeyRing returns the name of the key ring the team is assigned to, or the default key ring
+func (c Config) teamKeyRing(team string) string {
+	for _, keyRing := range c.KeyRings {
+		if slices.Contains(keyRing.Teams, team) {
+			return keyRing.Name
+		}
+	}
+	return DefaultKeyRing
+}
+
+// tokenIssuer returns the issuer of tokens of the given token config
+func (c Config) tokenIssuer(tokenConfig TokenConfig) string {
+	for _, keyRing := range c.AllKeyRings() {
+		if keyRing.Name == tokenConfig.KeyRing {
+			return keyRing.Issuer(c.ExternalURL)
+		}
+	}
+	return c.ExternalURL
+}
+
+// AllKeyRings returns the default key ring, configured by key.*, followed by all configured key rings
+func (c Config) AllKeyRings() []KeyRingConfig {
+	defaultKeyRing := KeyRingConfig{
+		Name:             DefaultKeyRing,
+		Path:             defaultKeyLocation,
+		RotationPeriod:   c.KeyOpts.RotationPeriod,
+		RotationSchedule: c.KeyOpts.RotationSchedule,
+		MaxAge:           c.KeyOpts.MaxAge,
+		PrePublishPeriod: c.KeyOpts.PrePublish,
+	}
+	return append([]KeyRingConfig{defaultKeyRing}, c.KeyRings...)
+}
+
+// KeyLocations returns the storage locations of all key rings
+func (c Config) KeyLocations() []string {
+	keyRings := c.AllKeyRings()
+	locations := make([]string, len(keyRings))
+	for i, keyRing := range keyRings {
+		locations[i] = keyRing.Path
+	}
+	return locations
+}
+
+func loadVaultOpts(v *viper.Viper) VaultOpts {
+	return VaultOpts{
+		URL:           v.GetString("vault.url"),
+		Token:         v.GetString("vault.token"),
+		ApproleID:     v.GetString("vault.approleId"),
+		ApproleSecret: v.GetString("vault.approleSecret"),
+		ConcoursePath: v.GetString("vault.concoursePath"),
+		ConfigPath:    v.GetString("vault.configPath"),
+	}
+}
+
+// loadClaimNames restores the case of the names of custom claims and claim variables that have been read from the config-file,
+// as viper lowercases all keys. Values from environment variables keep their case. Returns an error if the case can not be restored.
+func loadClaimNames(v *viper.Viper, cfg *Config) error {
+	raw := map[string]interface{}{}
+	if file := v.ConfigFileUsed(); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error when reading claims from %s: %w", file, err)
+		}
+		err = yaml.Unmarshal(data, &raw)
+		if err != nil {
+			return fmt.Errorf("error when reading claims from %s: %w", file, err)
+		}
+	}
+
+	// the values differ from the config-file if they have been overridden, e.g. by an environment variable
+	if claims, ok := lookupKey(raw, "claims").(map[string]interface{}); ok && reflect.DeepEqual(lowercaseKeys(claims), cfg.Claims) {
+		cfg.Claims = claims
+	}
+	if vars, ok := lookupKey(raw, "claimVariables").(map[string]interface{}); ok && sameNames(lowercaseKeys(vars).(map[string]interface{}), cfg.ClaimVariables) {
+		cfg.ClaimVariables = make(map[string]string, len(vars))
+		for name, value := range vars {
+			cfg.ClaimVariables[name] = fmt.Sprint(value)
+		}
+	}
+
+	tokens, _ := lookupKey(raw, "tokens").([]interface{})
+	for i := range cfg.Tokens {
+		if len(cfg.Tokens[i].Claims) == 0 {
+			continue
+		}
+		if len(tokens) != len(cfg.Tokens) {
+			return fmt.Errorf("can not restore the case of the claim names of the token configs, as they are not set in the config-file")
+		}
+		token, _ := tokens[i].(map[string]interface{})
+		claims, _ := lookupKey(token, "claims").(map[string]interface{})
+		if !reflect.DeepEqual(lowercaseKeys(claims), cfg.Tokens[i].Claims) {
+			return fmt.Errorf("can not restore the case of the claim names of token config %d, as they differ from the config-file", i)
+		}
+		cfg.Tokens[i].Claims = claims
+	}
+	return nil
+}
+
+// lowercaseKeys returns a copy of value with the keys of all maps in it lowercased, like viper does
+func lowercaseKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		lowercased := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			lowercased[strings.ToLower(key)] = lowercaseKeys(item)
+		}
+		return lowercased
+	case []interface{}:
+		lowercased := make([]interface{}, len(value))
+		for i, item := range value {
+			lowercased[i] = lowercaseKeys(item)
+		}
+		return lowercased
+	default:
+		return value
+	}
+}
+
+// sameNames returns whether both maps contain the same keys
+func sameNames(a map[string]interface{}, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupKey returns the value of the key in m, ignoring the case of the key like viper does
+func lookupKey(m map[string]interface{}, key string) interface{} {
+	for name, value := range m {
+		if strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return nil
+}
+
 func (c Config) Validate() error {
 	if c.ExternalURL == "" {
 		return fmt.Errorf("externalURL must be set")
 	}
+	if err := c.ValidateBackend(); err != nil {
+		return err
+	}
+	tokens := make(map[string]bool)
+	for _, tokenConfig := range c.Tokens {
+		if err := tokenConfig.Validate(); err != nil {
+			return fmt.Errorf("invalid token config: %w", err)
+		}
+		if tokenConfig.SigningAlgorithm != "" && !slices.Contains(c.KeyOpts.Algorithms, tokenConfig.SigningAlgorithm) {
+			return fmt.Errorf("invalid token config %s: signingAlgorithm %s is not one of key.algorithms", tokenConfig, tokenConfig.SigningAlgorithm)
+		}
+		algorithm := tokenConfig.SigningAlgorithm
+		if algorithm == "" {
+			algorithm = c.KeyOpts.Algorithm
+		}
+		if err := tokenConfig.validateProfile(algorithm); err != nil {
+			return fmt.Errorf("invalid token config %s: %w", tokenConfig, err)
+		}
+		if tokens[tokenConfig.String()] {
+			return fmt.Errorf("duplicate token config %s", tokenConfig)
+		}
+		tokens[tokenConfig.String()] = true
+		if _, err := renderClaims(tokenConfig.Claims, tokenConfig.claimTemplateData(c.tokenIssuer(tokenConfig), c.ClaimVariables)); err != nil {
+			return fmt.Errorf("invalid token config %s: %w", tokenConfig, err)
+		}
+	}
+	if err := c.validateKeyRings(); err != nil {
+		return err
+	}
+	for _, webhookConfig := range c.Webhooks {
+		if err := webhookConfig.Validate(); err != nil {
+			return fmt.Errorf("invalid webhook config: %w", err)
+		}
+	}
+	for _, hook := range c.Hooks {
+		if err := hook.Validate(); err != nil {
+			return fmt.Errorf("invalid hook: %w", err)
+		}
+	}
+	if c.KeyOpts.PrePublish < 0 || c.KeyOpts.PrePublish >= c.KeyOpts.RotationPeriod {
+		return fmt.Errorf("key.prePublishPeriod must not be negative and must be smaller than key.rotationPeriod")
+	}
+	if _, err := ParseRotationSchedule(c.KeyOpts.RotationSchedule); err != nil {
+		return fmt.Errorf("invalid key.rotationSchedule: %w", err)
+	}
+	if c.KeyOpts.MaxAge <= c.KeyOpts.RotationPeriod+c.KeyOpts.PrePublish {
+		return fmt.Errorf("key.maxAge must be larger than key.rotationPeriod + key.prePublishPeriod")
+	}
+	for _, algorithm := range c.KeyOpts.Algorithms {
+		if !slices.Contains(supportedSignatureAlgorithms, jose.SignatureAlgorithm(algorithm)) {
+			return fmt.Errorf("unsupported signing algorithm %s, must be one of %v", algorithm, supportedSignatureAlgorithms)
+		}
+	}
+	if c.KeyOpts.RSABits < 2048 {
+		return fmt.Errorf("key.rsaBits must be at least 2048")
+	}
+	if c.KeyOpts.ReissueWindow < 0 {
+		return fmt.Errorf("key.reissueWindow must not be negative")
+	}
+	if (c.KeyOpts.CACert == "") != (c.KeyOpts.CAKey == "") {
+		return fmt.Errorf("key.caCert and key.caKey must be set together")
+	}
+	if err := c.validateKeyBackend(); err != nil {
+		return err
+	}
+	if c.SubjectOpts.MaxLength < 0 {
+		return fmt.Errorf("subject.maxLength must not be negative")
+	}
+	if c.HealthOpts.Interval <= 0 {
+		return fmt.Errorf("health.interval must be positive")
+	}
+	return nil
+}
+
+func (c Config) validateKeyBackend() error {
+	switch c.KeyOpts.Backend {
+	case "memory":
+		return nil
+	case "pkcs11":
+		if c.PKCS11Opts.Module == "" || c.PKCS11Opts.TokenLabel == "" {
+			return fmt.Errorf("pkcs11.module and pkcs11.tokenLabel must be set for key.backend pkcs11")
+		}
+		if slices.Contains(c.KeyOpts.Algorithms, string(jose.EdDSA)) {
+			return fmt.Errorf("EdDSA is not supported by key.backend pkcs11")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown key.backend %s, must be memory or pkcs11", c.KeyOpts.Backend)
+}
+
+func (c Config) validateKeyRings() error {
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	teams := make(map[string]string)
+	for _, keyRing := range c.KeyRings {
+		if err := keyRing.Validate(); err != nil {
+			return fmt.Errorf("invalid key ring %s: %w", keyRing.Name, err)
+		}
+		if names[keyRing.Name] {
+			return fmt.Errorf("duplicate key ring %s", keyRing.Name)
+		}
+		if paths[keyRing.Path] {
+			return fmt.Errorf("invalid key ring %s: path %s is used by another key ring", keyRing.Name, keyRing.Path)
+		}
+		for _, team := range keyRing.Teams {
+			if other, exists := teams[team]; exists {
+				return fmt.Errorf("team %s is assigned to key rings %s and %s", team, other, keyRing.Name)
+			}
+			teams[team] = keyRing.Name
+		}
+		names[keyRing.Name] = true
+		paths[keyRing.Path] = true
+	}
+	for _, tokenConfig := range c.Tokens {
+		if tokenConfig.KeyRing != DefaultKeyRing && !names[tokenConfig.KeyRing] {
+			return fmt.Errorf("invalid token config %s: key ring %s does not exist", tokenConfig, tokenConfig.KeyRing)
+		}
+	}
+	return c.validateKeyLifetimes()
+}
+
+// validateKeyLifetimes makes sure that keys stay in the JWKS until all tokens they signed have expired.
+// A key is removed maxAge - rotationPeriod - prePublishPeriod after its retirement, and may sign tokens until then.
+func (c Config) validateKeyLifetimes() error {
+	keyRings := c.AllKeyRings()
+	for _, tokenConfig := range c.Tokens {
+		i := slices.IndexFunc(keyRings, func(keyRing KeyRingConfig) bool { return keyRing.Name == tokenConfig.KeyRing })
+		if i == -1 {
+			continue
+		}
+		keyRing := keyRings[i]
+		publishedAfterRetirement := keyRing.MaxAge - keyRing.RotationPeriod - keyRing.PrePublishPeriod
+		if tokenConfig.ExpiresIn > publishedAfterRetirement {
+			return fmt.Errorf("invalid token config %s: expiresIn %s is longer than keys of the %s stay published after their retirement (maxAge - rotationPeriod - prePublishPeriod = %s)",
+				tokenConfig, tokenConfig.ExpiresIn, keyRing, publishedAfterRetirement)
+		}
+	}
+	return nil
+}
+
+// ValidateBackend validates only the storage-backend settings
+func (c Config) ValidateBackend() error {
 	if c.Backend != "dev" && c.Backend != "vault" {
 		return fmt.Errorf("backend must either be dev or vault")
 	}
@@ -134,13 +638,5 @@ func (c Config) Validate() error {
 			return fmt.Errorf("vault.token or vault.approleid+vault.approlesecret must be set")
 		}
 	}
-	for _, tokenConfig := range c.Tokens {
-		if err := tokenConfig.Validate(); err != nil {
-			return fmt.Errorf("invalid token config: %w", err)
-		}
-	}
-	if c.KeyOpts.MaxAge <= c.KeyOpts.RotationPeriod {
-		return fmt.Errorf("key.maxAge must be larger than key.rotationPeriod")
-	}
 	return nil
 }
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const claimsConfig = `
+claims:
+  costCenter: "4711"
+  Nested:
+    innerKey: [{deepKey: 1}]
+claimVariables:
+  ConcourseURL: https://ci.example.com
+tokens:
+  - pipeline: deploy
+    claims:
+      tokenClaim: "{{ .Vars.ConcourseURL }}"
+`
+
+// loadClaimsConfig loads the claims of the config like LoadConfig does
+func loadClaimsConfig(t *testing.T, config string) (Config, error) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetEnvPrefix("CPIDP_")
+	v.AutomaticEnv()
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Claims:         v.GetStringMap("claims"),
+		ClaimVariables: v.GetStringMapString("claimVariables"),
+	}
+	if err := v.UnmarshalKey("tokens", &cfg.Tokens); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, loadClaimNames(v, &cfg)
+}
+
+func TestClaimNamesKeepTheirCase(t *testing.T) {
+	cfg, err := loadClaimsConfig(t, claimsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"costCenter": "4711",
+		"Nested":     map[string]interface{}{"innerKey": []interface{}{map[string]interface{}{"deepKey": 1}}},
+	}
+	if !reflect.DeepEqual(cfg.Claims, expected) {
+		t.Errorf("expected claims %v, got %v", expected, cfg.Claims)
+	}
+	if cfg.ClaimVariables["ConcourseURL"] != "https://ci.example.com" {
+		t.Errorf("expected claim variable ConcourseURL, got %v", cfg.ClaimVariables)
+	}
+	if _, ok := cfg.Tokens[0].Claims["tokenClaim"]; !ok {
+		t.Errorf("expected token claim tokenClaim, got %v", cfg.Tokens[0].Claims)
+	}
+}
+
+func TestClaimNamesFromEnvKeepTheirCase(t *testing.T) {
+	t.Setenv("CPIDP__CLAIMS", `{"envClaim": "x", "Nested": {"innerKey": "y"}}`)
+	t.Setenv("CPIDP__CLAIMVARIABLES", `{"EnvVariable": "z"}`)
+	cfg, err := loadClaimsConfig(t, claimsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"envClaim": "x",
+		"Nested":   map[string]interface{}{"innerKey": "y"},
+	}
+	if !reflect.DeepEqual(cfg.Claims, expected) {
+		t.Errorf("expected claims %v, got %v", expected, cfg.Claims)
+	}
+	if !reflect.DeepEqual(cfg.ClaimVariables, map[string]string{"EnvVariable": "z"}) {
+		t.Errorf("expected claim variable EnvVariable, got %v", cfg.ClaimVariables)
+	}
+}
+
+func TestClaimNamesNotInConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("externalUrl: http://localhost\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Tokens: []TokenConfig{{Claims: map[string]interface{}{"lowercased": "x"}}}}
+	if err := loadClaimNames(v, &cfg); err == nil {
+		t.Error("expected an error, as the case of the token claims can not be restored")
+	}
+}
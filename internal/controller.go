@@ -2,8 +2,11 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"sync"
 	"time"
 )
 
@@ -11,13 +14,38 @@ type Controller struct {
 	TokenConfigs   []TokenConfig
 	TokenGenerator *TokenGenerator
 	Storage        Storage
+	// Destinations receive every renewed token in addition to Storage
+	Destinations []TokenWriter
+	// Hooks are run after every renewal, in addition to the hooks of the TokenConfig
+	Hooks []HookConfig
+	// ReissueOnRotation reissues all tokens signed by the previous key once the active key changes
+	ReissueOnRotation bool
+	// ReissueWindow is the time over which reissues after a rotation are spread
+	ReissueWindow time.Duration
 
-	cache map[string]cacheEntry
+	cache      map[string]cacheEntry
+	status     map[string]TokenStatus
+	statusLock sync.RWMutex
+
+	reissueKIDs map[string]bool
+	wake        chan struct{}
+	reissueLock sync.Mutex
 }
 
 type cacheEntry struct {
-	Token   string
-	RenewAt time.Time
+	Token       string
+	KeyID       string
+	RenewAt     time.Time
+	RenewBefore time.Duration
+}
+
+// TokenStatus is the state of a managed token as reported by the status endpoint
+type TokenStatus struct {
+	Token       string       `json:"token"`
+	LastRenewal time.Time    `json:"lastRenewal"`
+	RenewAt     time.Time    `json:"renewAt"`
+	LastError   string       `json:"lastError,omitempty"`
+	Hooks       []HookResult `json:"hooks,omitempty"`
 }
 
 func (c *Controller) Run(ctx context.Context) error {
@@ -28,8 +56,96 @@ func (c *Controller) Run(ctx context.Context) error {
 		nextRun := c.getNextRenewalTime()
 		delay := time.Until(nextRun)
 		if delay > 0 {
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-c.wakeChannel():
+			}
+		}
+	}
+}
+
+// ReissueTokensSignedBy reissues all tokens signed by one of the given keys during the next run, and wakes up Run
+func (c *Controller) ReissueTokensSignedBy(kids ...string) {
+	c.reissueLock.Lock()
+	defer c.reissueLock.Unlock()
+	if c.reissueKIDs == nil {
+		c.reissueKIDs = make(map[string]bool)
+	}
+	for _, kid := range kids {
+		c.reissueKIDs[kid] = true
+	}
+	c.wakeUpLocked()
+}
+
+// KeysChanged wakes up Run, so renewal times are checked against the new scheduled key removals
+func (c *Controller) KeysChanged() {
+	c.reissueLock.Lock()
+	defer c.reissueLock.Unlock()
+	c.wakeUpLocked()
+}
+
+func (c *Controller) wakeUpLocked() {
+	select {
+	case c.wakeChannelLocked() <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Controller) wakeChannel() chan struct{} {
+	c.reissueLock.Lock()
+	defer c.reissueLock.Unlock()
+	return c.wakeChannelLocked()
+}
+
+func (c *Controller) wakeChannelLocked() chan struct{} {
+	if c.wake == nil {
+		c.wake = make(chan struct{}, 1)
+	}
+	return c.wake
+}
+
+// applyRequestedReissues marks all cached tokens signed by keys passed to ReissueTokensSignedBy for renewal
+func (c *Controller) applyRequestedReissues() {
+	c.reissueLock.Lock()
+	defer c.reissueLock.Unlock()
+	for key, entry := range c.cache {
+		if c.reissueKIDs[entry.KeyID] {
+			log.Printf("Token %s has been signed by revoked key %s and will be reissued", key, entry.KeyID)
+			entry.RenewAt = time.Now()
+			c.cache[key] = entry
+		}
+	}
+	c.reissueKIDs = nil
+}
+
+// scheduleRotationReissues schedules the renewal of all cached tokens that have not been signed by the current key for their TokenConfig.
+// The renewals are spread evenly over ReissueWindow.
+func (c *Controller) scheduleRotationReissues() {
+	rotated := make([]TokenConfig, 0)
+	for _, t := range c.TokenConfigs {
+		cached, exists := c.cache[t.String()]
+		if !exists {
+			continue
+		}
+		currentKeyID, err := c.TokenGenerator.CurrentKeyID(t)
+		if err == nil && cached.KeyID != currentKeyID {
+			rotated = append(rotated, t)
+		}
+	}
+
+	now := time.Now()
+	for i, t := range rotated {
+		entry := c.cache[t.String()]
+		reissueAt := now.Add(c.ReissueWindow * time.Duration(i) / time.Duration(len(rotated)))
+		if !reissueAt.Before(entry.RenewAt) {
+			continue
 		}
+		log.Printf("Token %s has been signed by rotated key %s and will be reissued at %s", t, entry.KeyID, reissueAt)
+		entry.RenewAt = reissueAt
+		c.cache[t.String()] = entry
+		c.updateStatus(t, func(status *TokenStatus) {
+			status.RenewAt = reissueAt
+		})
 	}
 }
 
@@ -39,11 +155,18 @@ func (c *Controller) RunOnce(ctx context.Context) error {
 			return err
 		}
 	}
+	c.applyRequestedReissues()
+	if c.ReissueOnRotation {
+		c.scheduleRotationReissues()
+	}
 
 	for _, t := range c.TokenConfigs {
 		renewed, err := c.handleTokenConfig(ctx, t)
 		if err != nil {
 			log.Printf("Error when renewing token %s: %s", t, err)
+			c.updateStatus(t, func(status *TokenStatus) {
+				status.LastError = err.Error()
+			})
 		} else if renewed {
 			log.Printf("Renewed token %s", t)
 		}
@@ -57,13 +180,22 @@ func (c *Controller) populateCache(ctx context.Context) error {
 	for _, t := range c.TokenConfigs {
 		currentToken, err := c.Storage.ReadToken(ctx, t)
 		if err == nil {
-			isValid, validUntil, err := c.TokenGenerator.IsTokenStillValid(currentToken)
-			if err == nil && isValid {
-				log.Printf("Found existing valid token %s", t)
+			validity, err := c.TokenGenerator.VerifyToken(t, currentToken)
+			if err != nil {
+				log.Printf("Existing token %s can not be parsed and will be reissued: %s", t, err)
+			} else if !validity.Valid {
+				log.Printf("Existing token %s is not valid and will be reissued: %s", t, validity.Reason)
+			} else {
+				log.Printf("Found existing valid token %s, signed by key %s and valid for %s", t, validity.KeyID, validity.Remaining.Round(time.Second))
 				c.cache[t.String()] = cacheEntry{
-					Token:   currentToken,
-					RenewAt: c.calculateRenewalTime(validUntil, t.RenewBefore),
+					Token:       currentToken,
+					KeyID:       validity.KeyID,
+					RenewAt:     c.calculateRenewalTime(validity.ExpiresAt, t.RenewBefore),
+					RenewBefore: t.RenewBefore,
 				}
+				c.updateStatus(t, func(status *TokenStatus) {
+					status.RenewAt = c.cache[t.String()].RenewAt
+				})
 			}
 		} else if err != ErrTokenNotFound {
 			return err
@@ -86,33 +218,123 @@ func (c *Controller) handleTokenConfig(ctx context.Context, t TokenConfig) (bool
 		}
 
 		c.cache[t.String()] = cacheEntry{
-			Token:   newToken,
-			RenewAt: c.calculateRenewalTime(validUntil, t.RenewBefore),
+			Token:       newToken,
+			KeyID:       tokenKeyID(newToken),
+			RenewAt:     c.calculateRenewalTime(validUntil, t.RenewBefore),
+			RenewBefore: t.RenewBefore,
 		}
 
+		c.writeToDestinations(ctx, t, newToken)
+		hookResults := c.runHooks(ctx, t, newToken, validUntil)
+
+		c.updateStatus(t, func(status *TokenStatus) {
+			status.LastRenewal = time.Now()
+			status.RenewAt = c.cache[t.String()].RenewAt
+			status.LastError = ""
+			status.Hooks = hookResults
+		})
+
 		return true, nil
 	}
 	return false, nil
 }
 
-func (c Controller) tokenNeedsToBeRenewed(t TokenConfig) bool {
+// writeToDestinations writes the token to all additional destinations.
+// Errors are only logged, as the token has already been stored successfully.
+func (c *Controller) writeToDestinations(ctx context.Context, t TokenConfig, token string) {
+	for _, dest := range c.Destinations {
+		err := dest.WriteToken(ctx, t, token)
+		if err != nil {
+			log.Printf("Error when writing token %s to destination %s: %s", t, dest, err)
+		}
+	}
+}
+
+// runHooks runs the global hooks and the hooks of the TokenConfig and logs their results
+func (c *Controller) runHooks(ctx context.Context, t TokenConfig, token string, validUntil time.Time) []HookResult {
+	hooks := append(append([]HookConfig{}, c.Hooks...), t.Hooks...)
+	results := make([]HookResult, 0, len(hooks))
+	for _, hook := range hooks {
+		result := hook.Run(ctx, t, token, validUntil)
+		if result.Error != "" {
+			log.Printf("Hook '%s' for token %s failed with exit-code %d: %s", hook, t, result.ExitCode, result.Error)
+		} else {
+			log.Printf("Hook '%s' for token %s succeeded", hook, t)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (c *Controller) updateStatus(t TokenConfig, update func(status *TokenStatus)) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	if c.status == nil {
+		c.status = make(map[string]TokenStatus)
+	}
+	status := c.status[t.String()]
+	status.Token = t.String()
+	update(&status)
+	c.status[t.String()] = status
+}
+
+// Status returns the current status of all managed tokens
+func (c *Controller) Status() []TokenStatus {
+	c.statusLock.RLock()
+	defer c.statusLock.RUnlock()
+	statuses := make([]TokenStatus, 0, len(c.TokenConfigs))
+	for _, t := range c.TokenConfigs {
+		status, exists := c.status[t.String()]
+		if !exists {
+			status.Token = t.String()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// ServeStatus serves the status of all managed tokens as JSON
+func (c *Controller) ServeStatus(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(c.Status())
+}
+
+func (c *Controller) tokenNeedsToBeRenewed(t TokenConfig) bool {
 	if cached, exists := c.cache[t.String()]; exists {
-		if time.Now().Before(cached.RenewAt) {
+		renewAt, beforeRemoval := c.renewalTime(cached)
+		if time.Now().Before(renewAt) {
 			return false
 		}
+		if beforeRemoval {
+			log.Printf("Token %s has been signed by key %s, which is removed from the JWKS before the token expires. Reissuing", t, cached.KeyID)
+		}
 	}
 	return true
 }
 
-func (c Controller) calculateRenewalTime(validUntil time.Time, renewBefore time.Duration) time.Time {
+// renewalTime returns when the cached token has to be renewed. Tokens signed by a key that is removed from the JWKS
+// before they expire are renewed RenewBefore ahead of the removal. Returns whether the renewal is caused by the removal.
+func (c *Controller) renewalTime(entry cacheEntry) (time.Time, bool) {
+	removal, scheduled := c.TokenGenerator.KeyRemovalTime(entry.KeyID)
+	if !scheduled {
+		return entry.RenewAt, false
+	}
+	renewBeforeRemoval := removal.Add(-entry.RenewBefore)
+	if renewBeforeRemoval.Before(entry.RenewAt) {
+		return renewBeforeRemoval, true
+	}
+	return entry.RenewAt, false
+}
+
+func (c *Controller) calculateRenewalTime(validUntil time.Time, renewBefore time.Duration) time.Time {
 	return validUntil.Add(-(renewBefore - 2*time.Second))
 }
 
-func (c Controller) getNextRenewalTime() time.Time {
+func (c *Controller) getNextRenewalTime() time.Time {
 	next := time.Now().Add(24 * time.Hour)
 	for _, entry := range c.cache {
-		if entry.RenewAt.Before(next) {
-			next = entry.RenewAt
+		if renewAt, _ := c.renewalTime(entry); renewAt.Before(next) {
+			next = renewAt
 		}
 	}
 	return next
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// WebhookSignatureHeader contains the hex-encoded HMAC-SHA256 of the request body, prefixed with "sha256="
+const WebhookSignatureHeader = "X-Cpidp-Signature"
+
+type WebhookConfig struct {
+	URL string
+	// Secret is used as key for the HMAC signature of the requests
+	Secret  string
+	Timeout time.Duration
+	// Retries is how often failed requests are retried. nil means the default, 0 disables retries
+	Retries    *int
+	RetryDelay time.Duration
+	TLS        WebhookTLSConfig
+}
+
+type WebhookTLSConfig struct {
+	CACert     string
+	ClientCert string
+	ClientKey  string
+}
+
+var DefaultWebhookConfig = WebhookConfig{
+	Timeout:    10 * time.Second,
+	RetryDelay: 1 * time.Second,
+}
+
+// defaultWebhookRetries is used if retries is not set
+const defaultWebhookRetries = 3
+
+func (c *WebhookConfig) FillWithDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultWebhookConfig.Timeout
+	}
+	if c.Retries == nil {
+		retries := defaultWebhookRetries
+		c.Retries = &retries
+	}
+	if c.RetryDelay == 0 {
+		c.RetryDelay = DefaultWebhookConfig.RetryDelay
+	}
+}
+
+func (c WebhookConfig) Validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("url must not be empty")
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("secret must not be empty")
+	}
+	if c.Retries != nil && *c.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	if (c.TLS.ClientCert == "") != (c.TLS.ClientKey == "") {
+		return fmt.Errorf("tls.clientCert and tls.clientKey must be set together")
+	}
+	return nil
+}
+
+// Webhook is a token destination that POSTs every token together with its metadata to an URL
+type Webhook struct {
+	config WebhookConfig
+	client *http.Client
+}
+
+// WebhookPayload is the body of the requests sent by Webhook
+type WebhookPayload struct {
+	Team      string    `json:"team"`
+	Pipeline  string    `json:"pipeline"`
+	Path      string    `json:"path"`
+	Subject   string    `json:"subject"`
+	Audience  []string  `json:"audience"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Token     string    `json:"token"`
+}
+
+// NewWebhook creates a Webhook. Unset values of the config are filled with their defaults.
+func NewWebhook(config WebhookConfig) (*Webhook, error) {
+	config.FillWithDefaults()
+	tlsConfig := &tls.Config{}
+
+	if config.TLS.CACert != "" {
+		caCert, err := os.ReadFile(config.TLS.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("error when reading ca-cert: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", config.TLS.CACert)
+		}
+	}
+
+	if config.TLS.ClientCert != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.TLS.ClientCert, config.TLS.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error when loading client-certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &Webhook{
+		config: config,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+		},
+	}, nil
+}
+
+func (w *Webhook) WriteToken(ctx context.Context, t TokenConfig, token string) error {
+	payload := WebhookPayload{
+		Team:     t.Team,
+		Pipeline: t.Pipeline,
+		Path:     t.Path,
+		Subject:  t.Subject(),
+		Audience: t.Audience,
+		Token:    token,
+	}
+
+	parsed, err := jwt.ParseSigned(token, supportedSignatureAlgorithms)
+	if err != nil {
+		return err
+	}
+	claims := jwt.Claims{}
+	err = parsed.UnsafeClaimsWithoutVerification(&claims)
+	if err != nil {
+		return err
+	}
+	payload.IssuedAt = claims.IssuedAt.Time()
+	payload.ExpiresAt = claims.Expiry.Time()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	delay := w.config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retryable, err := w.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= *w.config.Retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// send sends the body once. Returns whether the request should be retried if it failed
+func (w *Webhook) send(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, "sha256="+w.sign(body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("webhook responded with status %s", resp.Status)
+}
+
+func (w *Webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.config.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) String() string {
+	return "webhook " + w.config.URL
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthMonitor periodically checks the health of the storage-backend and reports the result as readiness-state
+type HealthMonitor struct {
+	Storage      Storage
+	Tokens       []TokenConfig
+	KeyLocations []string
+	Interval     time.Duration
+
+	lock      sync.RWMutex
+	checked   bool
+	lastErr   error
+	lastCheck time.Time
+}
+
+// HealthStatus is the readiness-state as reported by the readiness endpoint
+type HealthStatus struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	LastCheck time.Time `json:"lastCheck"`
+}
+
+func (h *HealthMonitor) Run(ctx context.Context) {
+	for {
+		h.CheckOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(h.Interval):
+		}
+	}
+}
+
+// CheckOnce checks the health of the storage-backend and logs changes of the health-state
+func (h *HealthMonitor) CheckOnce(ctx context.Context) error {
+	checkCtx, cancel := context.WithTimeout(ctx, h.Interval)
+	defer cancel()
+	err := h.Storage.CheckHealth(checkCtx, h.Tokens, h.KeyLocations)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err != nil && (!h.checked || h.lastErr == nil || h.lastErr.Error() != err.Error()) {
+		log.Printf("Storage backend is degraded: %s", err)
+	} else if err == nil && h.checked && h.lastErr != nil {
+		log.Println("Storage backend is healthy again")
+	}
+
+	h.checked = true
+	h.lastErr = err
+	h.lastCheck = time.Now()
+	return err
+}
+
+// Status returns the result of the last health-check
+func (h *HealthMonitor) Status() HealthStatus {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	switch {
+	case !h.checked:
+		return HealthStatus{Status: "unknown"}
+	case h.lastErr != nil:
+		return HealthStatus{Status: "degraded", Error: h.lastErr.Error(), LastCheck: h.lastCheck}
+	default:
+		return HealthStatus{Status: "ok", LastCheck: h.lastCheck}
+	}
+}
+
+// ServeReady responds with 200 if the last health-check succeeded and 503 otherwise
+func (h *HealthMonitor) ServeReady(writer http.ResponseWriter, request *http.Request) {
+	status := h.Status()
+	writer.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(writer).Encode(status)
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// HookConfig configures a command that is run after a token has been renewed.
+// The token is passed to the command via stdin, metadata via CPIDP_* environment variables.
+type HookConfig struct {
+	Command []string
+	Timeout time.Duration
+	// TokenInEnv additionally passes the token via the environment variable CPIDP_TOKEN
+	TokenInEnv bool
+}
+
+// HookResult is the outcome of a single hook execution
+type HookResult struct {
+	Command  string    `json:"command"`
+	RanAt    time.Time `json:"ranAt"`
+	ExitCode int       `json:"exitCode"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// hookWaitDelay is how long Run waits for the output of processes started by a hook after the hook has been killed
+const hookWaitDelay = time.Second
+
+var DefaultHookConfig = HookConfig{
+	Timeout: 30 * time.Second,
+}
+
+func (h *HookConfig) FillWithDefaults() {
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHookConfig.Timeout
+	}
+}
+
+func (h HookConfig) Validate() error {
+	if len(h.Command) == 0 {
+		return fmt.Errorf("command must not be empty")
+	}
+	return nil
+}
+
+func (h HookConfig) String() string {
+	return strings.Join(h.Command, " ")
+}
+
+// Run executes the hook for the given token. Failures are reported in the returned result.
+func (h HookConfig) Run(ctx context.Context, t TokenConfig, token string, validUntil time.Time) HookResult {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	result := HookResult{
+		Command: h.String(),
+		RanAt:   time.Now(),
+	}
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	killProcessGroupOnCancel(cmd)
+	cmd.WaitDelay = hookWaitDelay
+	cmd.Stdin = strings.NewReader(token)
+	cmd.Env = append(os.Environ(),
+		"CPIDP_TEAM="+t.Team,
+		"CPIDP_PIPELINE="+t.Pipeline,
+		"CPIDP_PATH="+t.Path,
+		"CPIDP_SUBJECT="+t.Subject(),
+		"CPIDP_AUDIENCE="+strings.Join(t.Audience, ","),
+		"CPIDP_EXPIRES_AT="+validUntil.Format(time.RFC3339),
+	)
+	if h.TokenInEnv {
+		cmd.Env = append(cmd.Env, "CPIDP_TOKEN="+token)
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		} else {
+			result.ExitCode = -1
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", h.Timeout)
+		}
+		result.Error = err.Error()
+		if output.Len() > 0 {
+			result.Error += ": " + strings.TrimSpace(output.String())
+		}
+	}
+
+	return result
+}
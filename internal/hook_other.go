@@ -0,0 +1,8 @@
+//go:build !unix
+
+package internal
+
+import "os/exec"
+
+// killProcessGroupOnCancel does nothing, process groups are only supported on unix. Only the command itself is killed.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookTimeoutKillsChildProcesses(t *testing.T) {
+	for _, script := range []string{"sleep 5 & wait; true", "sleep 5 | cat"} {
+		t.Run(script, func(t *testing.T) {
+			hook := HookConfig{Command: []string{"sh", "-c", script}, Timeout: 500 * time.Millisecond}
+			start := time.Now()
+			result := hook.Run(context.Background(), TokenConfig{}, "token", time.Now())
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("hook blocked for %s despite a timeout of %s", elapsed, hook.Timeout)
+			}
+			if !strings.Contains(result.Error, "timed out") {
+				t.Errorf("expected a timeout, got %q", result.Error)
+			}
+		})
+	}
+}
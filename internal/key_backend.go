@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// KeyBackend holds the private keys of signing keys and signs with them
+type KeyBackend interface {
+	// GenerateKey generates a new key for the algorithm. bits is only used for RSA keys. The kid is the RFC 7638 thumbprint of the key.
+	// If the private key can not be exported from the backend, the returned JWK only contains the public key.
+	GenerateKey(algorithm string, bits int) (jose.JSONWebKey, error)
+	// ImportKey adds an existing private key to the backend and returns the key as it is stored in the keyset
+	ImportKey(key jose.JSONWebKey) (jose.JSONWebKey, error)
+	// Signer returns a signer for the private key of the given key
+	Signer(key jose.JSONWebKey) (crypto.Signer, error)
+	// DeleteKey destroys the private key with the given kid
+	DeleteKey(kid string) error
+	// PublicKeys returns the public keys of all private keys held by the backend
+	PublicKeys() ([]jose.JSONWebKey, error)
+}
+
+// MemoryKeyBackend keeps the private keys in the JWKs of the keyset, which is stored in the storage-backend. This is the default KeyBackend.
+type MemoryKeyBackend struct{}
+
+func (MemoryKeyBackend) GenerateKey(algorithm string, bits int) (jose.JSONWebKey, error) {
+	key, err := GenerateNewKey(algorithm, bits)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	return *key, nil
+}
+
+func (MemoryKeyBackend) ImportKey(key jose.JSONWebKey) (jose.JSONWebKey, error) {
+	return key, nil
+}
+
+func (MemoryKeyBackend) Signer(key jose.JSONWebKey) (crypto.Signer, error) {
+	signer, ok := key.Key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s does not contain a private key", key.KeyID)
+	}
+	return signer, nil
+}
+
+// DeleteKey does nothing, as the private key is deleted together with the keyset entry
+func (MemoryKeyBackend) DeleteKey(kid string) error {
+	return nil
+}
+
+// PublicKeys returns no keys, as MemoryKeyBackend holds no keys outside of the keyset
+func (MemoryKeyBackend) PublicKeys() ([]jose.JSONWebKey, error) {
+	return nil, nil
+}
+
+// NewKeyBackend creates the KeyBackend selected by key.backend
+func NewKeyBackend(cfg Config) (KeyBackend, error) {
+	switch cfg.KeyOpts.Backend {
+	case "pkcs11":
+		return NewPKCS11KeyBackend(cfg.PKCS11Opts)
+	default:
+		return MemoryKeyBackend{}, nil
+	}
+}
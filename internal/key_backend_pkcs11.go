@@ -0,0 +1,590 @@
+//go:build cgo
+
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"slices"
+	"sync"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+)
+
+// digestInfoPrefixes are the DER-encoded DigestInfo prefixes for RSA PKCS #1 v1.5 signatures, which CKM_RSA_PKCS does not add itself
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pssMechanisms maps hashes to the PKCS#11 hash and MGF used for RSASSA-PSS signatures
+var pssMechanisms = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// sessionErrors are the errors after which the session is reopened, as they occur after a restart or failover of the HSM
+var sessionErrors = []pkcs11.Error{
+	pkcs11.CKR_SESSION_HANDLE_INVALID,
+	pkcs11.CKR_SESSION_CLOSED,
+	pkcs11.CKR_USER_NOT_LOGGED_IN,
+	pkcs11.CKR_OBJECT_HANDLE_INVALID,
+	pkcs11.CKR_KEY_HANDLE_INVALID,
+	pkcs11.CKR_DEVICE_REMOVED,
+	pkcs11.CKR_TOKEN_NOT_PRESENT,
+	pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+}
+
+// PKCS11KeyBackend holds the private keys as non-extractable objects on a PKCS#11 token, e.g. an HSM or SoftHSM.
+// Private keys never leave the token, the keyset only contains their public keys. Objects are identified by the kid in CKA_ID and CKA_LABEL.
+// If the session is lost, e.g. after a restart of the HSM, a new session is opened and the operation is retried.
+type PKCS11KeyBackend struct {
+	ctx     *pkcs11.Ctx
+	opts    PKCS11Opts
+	session pkcs11.SessionHandle
+	// sessionCount is incremented for every opened session, so signers know when to look up their object handles again
+	sessionCount int
+	// lock serializes all operations, as a PKCS#11 session must not be used concurrently
+	lock sync.Mutex
+}
+
+// NewPKCS11KeyBackend loads the PKCS#11 module and logs in to the token with the configured label
+func NewPKCS11KeyBackend(opts PKCS11Opts) (KeyBackend, error) {
+	ctx := pkcs11.New(opts.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("could not load PKCS#11 module %s", opts.Module)
+	}
+	b := &PKCS11KeyBackend{
+		ctx:  ctx,
+		opts: opts,
+	}
+	err := b.openSession()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// openSession initializes the module if necessary, opens a new session on the token and logs in. Must be called while holding the lock,
+// unless the backend is not in use yet.
+func (b *PKCS11KeyBackend) openSession() error {
+	err := b.ctx.Initialize()
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return fmt.Errorf("error when initializing PKCS#11 module: %w", err)
+	}
+	if b.sessionCount > 0 {
+		b.ctx.CloseSession(b.session)
+	}
+
+	slots, err := b.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("error when listing PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := b.ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != b.opts.TokenLabel {
+			continue
+		}
+
+		session, err := b.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return fmt.Errorf("error when opening PKCS#11 session: %w", err)
+		}
+		err = b.ctx.Login(session, pkcs11.CKU_USER, b.opts.Pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			b.ctx.CloseSession(session)
+			return fmt.Errorf("error when logging in to PKCS#11 token %s: %w", b.opts.TokenLabel, err)
+		}
+		b.session = session
+		b.sessionCount++
+		return nil
+	}
+	return fmt.Errorf("no PKCS#11 token with label %s found", b.opts.TokenLabel)
+}
+
+// retry runs operation, and runs it again with a new session if it failed because the session has been lost. Must be called while holding the lock.
+func (b *PKCS11KeyBackend) retry(operation func() error) error {
+	err := operation()
+	var pkcs11Err pkcs11.Error
+	if !errors.As(err, &pkcs11Err) || !slices.Contains(sessionErrors, pkcs11Err) {
+		return err
+	}
+	log.Printf("PKCS#11 session has been lost (%s). Opening a new session", err)
+	if err := b.openSession(); err != nil {
+		return err
+	}
+	return operation()
+}
+
+func (b *PKCS11KeyBackend) GenerateKey(algorithm string, bits int) (jose.JSONWebKey, error) {
+	var mechanism *pkcs11.Mechanism
+	var publicTemplate []*pkcs11.Attribute
+	switch jose.SignatureAlgorithm(algorithm) {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)
+		publicTemplate = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		}
+	case jose.ES256, jose.ES384:
+		oid := oidNamedCurveP256
+		if algorithm == string(jose.ES384) {
+			oid = oidNamedCurveP384
+		}
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return jose.JSONWebKey{}, err
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)
+		publicTemplate = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+		}
+	default:
+		return jose.JSONWebKey{}, fmt.Errorf("signing algorithm %s is not supported by the PKCS#11 key backend", algorithm)
+	}
+	publicTemplate = append(publicTemplate,
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	)
+	privateTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var key jose.JSONWebKey
+	err := b.retry(func() error {
+		publicHandle, privateHandle, err := b.ctx.GenerateKeyPair(b.session, []*pkcs11.Mechanism{mechanism}, publicTemplate, privateTemplate)
+		if err != nil {
+			return fmt.Errorf("error when generating key on PKCS#11 token: %w", err)
+		}
+		key, err = b.identify(algorithm, publicHandle, privateHandle)
+		if err != nil {
+			b.ctx.DestroyObject(b.session, publicHandle)
+			b.ctx.DestroyObject(b.session, privateHandle)
+		}
+		return err
+	})
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	return key, nil
+}
+
+// identify reads the public key of a newly created key pair, and labels both objects with the kid of the key.
+// Must be called while holding the lock.
+func (b *PKCS11KeyBackend) identify(algorithm string, publicHandle pkcs11.ObjectHandle, privateHandle pkcs11.ObjectHandle) (jose.JSONWebKey, error) {
+	publicKey, err := b.publicKey(publicHandle)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	key := jose.JSONWebKey{
+		Algorithm: algorithm,
+		Key:       publicKey,
+		Use:       "sign",
+	}
+	key.KeyID, err = thumbprint(key)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+
+	label := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(key.KeyID)),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, key.KeyID),
+	}
+	for _, handle := range []pkcs11.ObjectHandle{publicHandle, privateHandle} {
+		err = b.ctx.SetAttributeValue(b.session, handle, label)
+		if err != nil {
+			return jose.JSONWebKey{}, fmt.Errorf("error when labeling key %s on PKCS#11 token: %w", key.KeyID, err)
+		}
+	}
+	return key, nil
+}
+
+// ImportKey stores the private key as non-extractable object on the token and returns its public key
+func (b *PKCS11KeyBackend) ImportKey(key jose.JSONWebKey) (jose.JSONWebKey, error) {
+	var publicTemplate, privateTemplate []*pkcs11.Attribute
+	switch privateKey := key.Key.(type) {
+	case *rsa.PrivateKey:
+		if len(privateKey.Primes) != 2 {
+			return jose.JSONWebKey{}, fmt.Errorf("multi-prime RSA keys are not supported by the PKCS#11 key backend")
+		}
+		privateKey.Precompute()
+		exponent := big.NewInt(int64(privateKey.E)).Bytes()
+		publicTemplate = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, privateKey.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, exponent),
+		}
+		privateTemplate = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, privateKey.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, exponent),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, privateKey.D.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, privateKey.Primes[0].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, privateKey.Primes[1].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, privateKey.Precomputed.Dp.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, privateKey.Precomputed.Dq.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, privateKey.Precomputed.Qinv.Bytes()),
+		}
+	case *ecdsa.PrivateKey:
+		var oid asn1.ObjectIdentifier
+		switch privateKey.Curve {
+		case elliptic.P256():
+			oid = oidNamedCurveP256
+		case elliptic.P384():
+			oid = oidNamedCurveP384
+		default:
+			return jose.JSONWebKey{}, fmt.Errorf("curve %s is not supported by the PKCS#11 key backend", privateKey.Curve.Params().Name)
+		}
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return jose.JSONWebKey{}, err
+		}
+		point, err := asn1.Marshal(elliptic.Marshal(privateKey.Curve, privateKey.X, privateKey.Y))
+		if err != nil {
+			return jose.JSONWebKey{}, err
+		}
+		value := make([]byte, (privateKey.Curve.Params().BitSize+7)/8)
+		privateKey.D.FillBytes(value)
+		publicTemplate = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		}
+		privateTemplate = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, value),
+		}
+	default:
+		return jose.JSONWebKey{}, fmt.Errorf("key type %T is not supported by the PKCS#11 key backend", key.Key)
+	}
+	publicTemplate = append(publicTemplate,
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	)
+	privateTemplate = append(privateTemplate,
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var imported jose.JSONWebKey
+	err := b.retry(func() error {
+		publicHandle, err := b.ctx.CreateObject(b.session, publicTemplate)
+		if err != nil {
+			return fmt.Errorf("error when importing public key to PKCS#11 token: %w", err)
+		}
+		privateHandle, err := b.ctx.CreateObject(b.session, privateTemplate)
+		if err != nil {
+			b.ctx.DestroyObject(b.session, publicHandle)
+			return fmt.Errorf("error when importing private key to PKCS#11 token: %w", err)
+		}
+		imported, err = b.identify(key.Algorithm, publicHandle, privateHandle)
+		if err != nil {
+			b.ctx.DestroyObject(b.session, publicHandle)
+			b.ctx.DestroyObject(b.session, privateHandle)
+		}
+		return err
+	})
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	return imported, nil
+}
+
+// Signer returns a signer that signs on the token. Keys that still contain their private key, because they have been created
+// before switching to the PKCS#11 key backend, are used directly until they are rotated.
+func (b *PKCS11KeyBackend) Signer(key jose.JSONWebKey) (crypto.Signer, error) {
+	if signer, ok := key.Key.(crypto.Signer); ok {
+		return signer, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	signer := &pkcs11Signer{
+		backend:   b,
+		kid:       key.KeyID,
+		publicKey: key.Key,
+	}
+	err := b.retry(signer.findHandle)
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+func (b *PKCS11KeyBackend) DeleteKey(kid string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.retry(func() error {
+		handles, err := b.findObjects(0, kid)
+		if err != nil {
+			return err
+		}
+		for _, handle := range handles {
+			err = b.ctx.DestroyObject(b.session, handle)
+			if err != nil {
+				return fmt.Errorf("error when deleting key %s from PKCS#11 token: %w", kid, err)
+			}
+		}
+		return nil
+	})
+}
+
+// PublicKeys returns the public keys of all key pairs on the token. The keys have no algorithm, as the token does not record it.
+func (b *PKCS11KeyBackend) PublicKeys() ([]jose.JSONWebKey, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var keys []jose.JSONWebKey
+	err := b.retry(func() error {
+		handles, err := b.findObjects(pkcs11.CKO_PUBLIC_KEY, "")
+		if err != nil {
+			return err
+		}
+		keys = make([]jose.JSONWebKey, 0, len(handles))
+		for _, handle := range handles {
+			attributes, err := b.ctx.GetAttributeValue(b.session, handle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, nil)})
+			if err != nil {
+				return fmt.Errorf("error when reading key id from PKCS#11 token: %w", err)
+			}
+			publicKey, err := b.publicKey(handle)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, jose.JSONWebKey{
+				KeyID: string(attributes[0].Value),
+				Key:   publicKey,
+				Use:   "sign",
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// findObjects returns the objects of the given class (any class if 0) with the kid as CKA_ID (any if empty). Must be called while holding the lock.
+func (b *PKCS11KeyBackend) findObjects(class uint, kid string) ([]pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{}
+	if class != 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_CLASS, class))
+	}
+	if kid != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(kid)))
+	}
+
+	err := b.ctx.FindObjectsInit(b.session, template)
+	if err != nil {
+		return nil, fmt.Errorf("error when searching PKCS#11 token: %w", err)
+	}
+	defer b.ctx.FindObjectsFinal(b.session)
+
+	handles := make([]pkcs11.ObjectHandle, 0)
+	for {
+		found, _, err := b.ctx.FindObjects(b.session, 100)
+		if err != nil {
+			return nil, fmt.Errorf("error when searching PKCS#11 token: %w", err)
+		}
+		if len(found) == 0 {
+			return handles, nil
+		}
+		handles = append(handles, found...)
+	}
+}
+
+// publicKey reads the RSA or EC public key object. Must be called while holding the lock.
+func (b *PKCS11KeyBackend) publicKey(handle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attributes, err := b.ctx.GetAttributeValue(b.session, handle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil)})
+	if err != nil {
+		return nil, fmt.Errorf("error when reading public key from PKCS#11 token: %w", err)
+	}
+	keyType := attributeUint(attributes[0].Value)
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attributes, err = b.ctx.GetAttributeValue(b.session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error when reading public key from PKCS#11 token: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attributes[0].Value),
+			E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+		}, nil
+	case pkcs11.CKK_EC:
+		attributes, err = b.ctx.GetAttributeValue(b.session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error when reading public key from PKCS#11 token: %w", err)
+		}
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(attributes[0].Value, &oid); err != nil {
+			return nil, fmt.Errorf("invalid EC parameters: %w", err)
+		}
+		var curve elliptic.Curve
+		switch {
+		case oid.Equal(oidNamedCurveP256):
+			curve = elliptic.P256()
+		case oid.Equal(oidNamedCurveP384):
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", oid)
+		}
+		var point []byte
+		if _, err := asn1.Unmarshal(attributes[1].Value, &point); err != nil {
+			return nil, fmt.Errorf("invalid EC point: %w", err)
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported PKCS#11 key type %d", keyType)
+}
+
+// attributeUint decodes a CK_ULONG attribute value, which is in native byte order
+func attributeUint(value []byte) uint64 {
+	switch len(value) {
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(value))
+	case 8:
+		return binary.NativeEndian.Uint64(value)
+	}
+	return 0
+}
+
+// pkcs11Signer implements crypto.Signer for a private key on a PKCS#11 token
+type pkcs11Signer struct {
+	backend *PKCS11KeyBackend
+	kid     string
+	// handle is the handle of the private key in the session with the number sessionCount. Handles can change with the session.
+	handle       pkcs11.ObjectHandle
+	sessionCount int
+	publicKey    crypto.PublicKey
+}
+
+// findHandle looks up the handle of the private key in the current session. Must be called while holding the lock of the backend.
+func (s *pkcs11Signer) findHandle() error {
+	handles, err := s.backend.findObjects(pkcs11.CKO_PRIVATE_KEY, s.kid)
+	if err != nil {
+		return err
+	}
+	if len(handles) == 0 {
+		return fmt.Errorf("private key of signing key %s not found on PKCS#11 token", s.kid)
+	}
+	s.handle = handles[0]
+	s.sessionCount = s.backend.sessionCount
+	return nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs the digest on the token. Signatures have the same format as the ones of the crypto package.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism *pkcs11.Mechanism
+	data := digest
+	switch s.publicKey.(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			hashMechanisms, ok := pssMechanisms[pssOpts.Hash]
+			if !ok {
+				return nil, fmt.Errorf("unsupported hash %s", pssOpts.Hash)
+			}
+			saltLength := pssOpts.SaltLength
+			if saltLength == rsa.PSSSaltLengthAuto || saltLength == rsa.PSSSaltLengthEqualsHash {
+				saltLength = pssOpts.Hash.Size()
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(hashMechanisms[0], hashMechanisms[1], uint(saltLength)))
+		} else {
+			prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("unsupported hash %s", opts.HashFunc())
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			data = append(append([]byte{}, prefix...), digest...)
+		}
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s.publicKey)
+	}
+
+	s.backend.lock.Lock()
+	defer s.backend.lock.Unlock()
+
+	var signature []byte
+	err := s.backend.retry(func() error {
+		if s.sessionCount != s.backend.sessionCount {
+			if err := s.findHandle(); err != nil {
+				return err
+			}
+		}
+		err := s.backend.ctx.SignInit(s.backend.session, []*pkcs11.Mechanism{mechanism}, s.handle)
+		if err != nil {
+			return fmt.Errorf("error when signing on PKCS#11 token: %w", err)
+		}
+		signature, err = s.backend.ctx.Sign(s.backend.session, data)
+		if err != nil {
+			return fmt.Errorf("error when signing on PKCS#11 token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.publicKey.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns r || s, the crypto package uses ASN.1
+		half := len(signature) / 2
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{
+			R: new(big.Int).SetBytes(signature[:half]),
+			S: new(big.Int).SetBytes(signature[half:]),
+		})
+	}
+	return signature, nil
+}
@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package internal
+
+import "fmt"
+
+// NewPKCS11KeyBackend fails, as PKCS#11 modules can only be loaded by builds with cgo
+func NewPKCS11KeyBackend(opts PKCS11Opts) (KeyBackend, error) {
+	return nil, fmt.Errorf("the PKCS#11 key backend requires a build with cgo enabled")
+}
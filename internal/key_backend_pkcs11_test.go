@@ -0,0 +1,210 @@
+//go:build cgo
+
+package internal
+
+import (
+	"crypto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/miekg/pkcs11"
+)
+
+// softHSMModules are the usual locations of the SoftHSM module. SOFTHSM2_MODULE takes precedence.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// newSoftHSMBackend initializes a SoftHSM token in a temporary directory and returns a backend for it.
+// Skips the test if SoftHSM is not installed.
+func newSoftHSMBackend(t *testing.T) *PKCS11KeyBackend {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		for _, candidate := range softHSMModules {
+			if _, err := os.Stat(candidate); err == nil {
+				module = candidate
+				break
+			}
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM is not installed, set SOFTHSM2_MODULE to the path of libsofthsm2.so")
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err := os.WriteFile(conf, []byte("directories.tokendir = "+dir+"\nobjectstore.backend = file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	const label, pin, soPin = "cpidp-test", "1234", "5678"
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("could not load %s", module)
+	}
+	err = ctx.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no free SoftHSM slot: %v", err)
+	}
+	err = ctx.InitToken(slots[0], soPin, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the token is moved to a new slot once it is initialized
+	slots, err = ctx.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != label {
+			continue
+		}
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ctx.Login(session, pkcs11.CKU_SO, soPin); err != nil {
+			t.Fatal(err)
+		}
+		if err = ctx.InitPIN(session, pin); err != nil {
+			t.Fatal(err)
+		}
+		ctx.Logout(session)
+		ctx.CloseSession(session)
+	}
+	t.Cleanup(func() {
+		ctx.Finalize()
+		ctx.Destroy()
+	})
+
+	backend := &PKCS11KeyBackend{ctx: ctx, opts: PKCS11Opts{Module: module, TokenLabel: label, Pin: pin}}
+	if err := backend.openSession(); err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+// signAndVerify signs a token with the key on the token and verifies the signature with its public key
+func signAndVerify(t *testing.T, backend *PKCS11KeyBackend, key jose.JSONWebKey) {
+	t.Helper()
+	signer, err := backend.Signer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joseSigner, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(key.Algorithm),
+		Key:       SigningKey{JWK: key, Signer: signer}.opaqueSigner(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := joseSigner.Sign([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Signatures[0].Header.KeyID != key.KeyID {
+		t.Errorf("expected kid %s, got %s", key.KeyID, signed.Signatures[0].Header.KeyID)
+	}
+	payload, err := signed.Verify(key.Key)
+	if err != nil {
+		t.Fatalf("signature of %s can not be verified: %s", key.Algorithm, err)
+	}
+	if string(payload) != "payload" {
+		t.Errorf("unexpected payload %s", payload)
+	}
+}
+
+func TestPKCS11KeyBackendSignatures(t *testing.T) {
+	backend := newSoftHSMBackend(t)
+
+	for _, algorithm := range []string{"RS256", "PS256", "ES256", "ES384"} {
+		t.Run(algorithm, func(t *testing.T) {
+			key, err := backend.GenerateKey(algorithm, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.IsPublic() {
+				t.Fatal("generated key must only contain the public key")
+			}
+			signAndVerify(t, backend, key)
+
+			err = backend.DeleteKey(key.KeyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := backend.Signer(key); err == nil {
+				t.Error("expected deleted key to be gone")
+			}
+		})
+	}
+}
+
+func TestPKCS11KeyBackendImport(t *testing.T) {
+	backend := newSoftHSMBackend(t)
+
+	for _, algorithm := range []string{"RS256", "ES256"} {
+		t.Run(algorithm, func(t *testing.T) {
+			private, err := GenerateNewKey(algorithm, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := backend.ImportKey(*private)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.KeyID != private.KeyID {
+				t.Errorf("expected kid %s, got %s", private.KeyID, key.KeyID)
+			}
+			signAndVerify(t, backend, key)
+		})
+	}
+}
+
+func TestPKCS11KeyBackendReopensLostSession(t *testing.T) {
+	backend := newSoftHSMBackend(t)
+
+	key, err := backend.GenerateKey("ES256", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signAndVerify(t, backend, key)
+	signer, err := backend.Signer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a restart of the HSM, which invalidates the session and the login
+	err = backend.ctx.CloseSession(backend.session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = signer.Sign(nil, make([]byte, 32), crypto.SHA256)
+	if err != nil {
+		t.Fatalf("signing after losing the session failed: %s", err)
+	}
+	if backend.sessionCount != 2 {
+		t.Errorf("expected a new session, got session number %d", backend.sessionCount)
+	}
+	keys, err := backend.PublicKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].KeyID != key.KeyID {
+		t.Errorf("expected the generated key, got %v", keys)
+	}
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// certificateClockSkew backdates the validity of certificates, to tolerate clock skew of relying parties
+const certificateClockSkew = 5 * time.Minute
+
+// CertificateIssuer mints X.509 certificates for signing keys, so they can be published with x5c, x5t and x5t#S256.
+// If CACertificate is nil, certificates are self-signed by the key itself.
+type CertificateIssuer struct {
+	CACertificate *x509.Certificate
+	CAKey         crypto.Signer
+}
+
+// LoadCertificateIssuer loads the CA certificate and private key from PEM files. If both are empty, certificates are self-signed.
+func LoadCertificateIssuer(certFile string, keyFile string) (*CertificateIssuer, error) {
+	if certFile == "" && keyFile == "" {
+		return &CertificateIssuer{}, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both the CA certificate and the CA key are required")
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", certFile)
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM private key", keyFile)
+	}
+	privateKey, err := parsePEMPrivateKey(block)
+	if err != nil {
+		return nil, err
+	}
+	caKey, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", privateKey)
+	}
+
+	return &CertificateIssuer{
+		CACertificate: caCert,
+		CAKey:         caKey,
+	}, nil
+}
+
+// NeedsCertificate returns whether the key has no certificate yet, its certificate expires before notAfter,
+// or it has not been issued by the current issuer
+func (i *CertificateIssuer) NeedsCertificate(key jose.JSONWebKey, notAfter time.Time) bool {
+	if len(key.Certificates) == 0 {
+		return true
+	}
+	leaf := key.Certificates[0]
+	if leaf.NotAfter.Before(notAfter.Truncate(time.Second)) {
+		return true
+	}
+	if i.CACertificate == nil {
+		return !bytes.Equal(leaf.RawIssuer, leaf.RawSubject)
+	}
+	return !bytes.Equal(leaf.RawIssuer, i.CACertificate.RawSubject)
+}
+
+// Issue mints a certificate for the key that is valid until notAfter, and sets it as certificate chain of the key.
+// signer is the private key of the key, which signs self-signed certificates.
+func (i *CertificateIssuer) Issue(key *jose.JSONWebKey, signer crypto.Signer, notBefore time.Time, notAfter time.Time) error {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: key.KeyID,
+		},
+		NotBefore: notBefore.Add(-certificateClockSkew),
+		// certificates only have a precision of seconds
+		NotAfter:              notAfter.Truncate(time.Second).Add(time.Second),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	parent, parentKey := template, signer
+	if i.CACertificate != nil {
+		parent, parentKey = i.CACertificate, i.CAKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, signer.Public(), parentKey)
+	if err != nil {
+		return fmt.Errorf("error when creating certificate for key %s: %w", key.KeyID, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	key.Certificates = []*x509.Certificate{cert}
+	if i.CACertificate != nil {
+		key.Certificates = append(key.Certificates, i.CACertificate)
+	}
+	sha1Sum := sha1.Sum(cert.Raw)
+	sha256Sum := sha256.Sum256(cert.Raw)
+	key.CertificateThumbprintSHA1 = sha1Sum[:]
+	key.CertificateThumbprintSHA256 = sha256Sum[:]
+	return nil
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// historyLocation is where the key histories are stored
+const historyLocation = "history"
+
+var ErrKeyHistoryNotFound = errors.New("no history found for signing key")
+
+// keyIDPattern matches the charset of base64url-encoded thumbprints, which can be used as storage paths as they are
+var keyIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// maxKeyIDLength limits the length of kids that are looked up in the key history
+const maxKeyIDLength = 256
+
+// encodedKeyIDPrefix marks the names of histories whose kid is stored base64url-encoded. It is not part of the base64url charset.
+const encodedKeyIDPrefix = "~"
+
+// ValidateKeyID checks a kid from an untrusted source, e.g. a request, before it is looked up in the key history
+func ValidateKeyID(kid string) error {
+	if kid == "" || len(kid) > maxKeyIDLength {
+		return fmt.Errorf("kid must be between 1 and %d bytes long", maxKeyIDLength)
+	}
+	if strings.IndexFunc(kid, func(r rune) bool { return !unicode.IsPrint(r) }) != -1 {
+		return fmt.Errorf("invalid kid %q, must not contain non-printable characters", kid)
+	}
+	return nil
+}
+
+// historyName returns the name the history of the key is stored under. Kids that are not thumbprints, e.g. of imported keys,
+// are base64url-encoded, so they can not point outside of the history location.
+func historyName(kid string) string {
+	if keyIDPattern.MatchString(kid) {
+		return kid
+	}
+	return encodedKeyIDPrefix + base64.RawURLEncoding.EncodeToString([]byte(kid))
+}
+
+// historyKeyID returns the kid of the history with the given name
+func historyKeyID(name string) (string, error) {
+	encoded, found := strings.CutPrefix(name, encodedKeyIDPrefix)
+	if !found {
+		return name, nil
+	}
+	kid, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid key history name %s: %w", name, err)
+	}
+	return string(kid), nil
+}
+
+type KeyEventType string
+
+const (
+	KeyGenerated KeyEventType = "generated"
+	KeyImported  KeyEventType = "imported"
+	KeyActivated KeyEventType = "activated"
+	KeyRetired   KeyEventType = "retired"
+	KeyRevoked   KeyEventType = "revoked"
+	// KeyRemoved is recorded once a key is deleted from the keyset after its scheduled removal from the JWKS
+	KeyRemoved KeyEventType = "removed"
+)
+
+// KeyEvent is a transition in the lifecycle of a signing key
+type KeyEvent struct {
+	Type KeyEventType `json:"type"`
+	// Time is when the transition takes effect. It may be later than Recorded for scheduled transitions
+	Time     time.Time `json:"time"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// KeyHistory is the append-only audit trail of a signing key. It outlives the key, so tokens can be verified against it later.
+type KeyHistory struct {
+	KeyRing string `json:"keyRing"`
+	// JWK is the public key
+	JWK    jose.JSONWebKey `json:"jwk"`
+	Events []KeyEvent      `json:"events"`
+}
+
+// lastEvent returns the time of the most recently recorded event of one of the given types, or zero if there is none
+func (h KeyHistory) lastEvent(types ...KeyEventType) time.Time {
+	for i := len(h.Events) - 1; i >= 0; i-- {
+		if slices.Contains(types, h.Events[i].Type) {
+			return h.Events[i].Time
+		}
+	}
+	return time.Time{}
+}
+
+// SignedAt returns whether the key has been used for signing at the given time
+func (h KeyHistory) SignedAt(t time.Time) bool {
+	activated := h.lastEvent(KeyActivated)
+	// tokens only record their issuance with a precision of seconds
+	if activated.IsZero() || t.Before(activated.Truncate(time.Second)) {
+		return false
+	}
+	retired := h.lastEvent(KeyRetired, KeyRevoked)
+	return retired.IsZero() || t.Before(retired)
+}
+
+// keyEvents returns the histories of all keys that changed between before and after, each containing only the new events.
+// Keys missing in after have been removed if their removal was due, otherwise they have been revoked.
+func keyEvents(keyRing string, before KeySet, after KeySet, now time.Time) []KeyHistory {
+	histories := make([]KeyHistory, 0)
+	add := func(key ManagedKey, events []KeyEvent) {
+		if len(events) > 0 {
+			histories = append(histories, KeyHistory{
+				KeyRing: keyRing,
+				JWK:     key.JWK.Public(),
+				Events:  events,
+			})
+		}
+	}
+
+	for _, key := range after {
+		lifecycle := key.Lifecycle
+		var previous KeyLifecycle
+		events := make([]KeyEvent, 0)
+		i := slices.IndexFunc(before, func(other ManagedKey) bool { return other.JWK.KeyID == key.JWK.KeyID })
+		if i == -1 {
+			created := KeyGenerated
+			if lifecycle.Imported {
+				created = KeyImported
+			}
+			events = append(events, KeyEvent{Type: created, Time: lifecycle.Created, Recorded: now})
+		} else {
+			previous = before[i].Lifecycle
+		}
+		if !lifecycle.Activated.IsZero() && !lifecycle.Activated.Equal(previous.Activated) {
+			events = append(events, KeyEvent{Type: KeyActivated, Time: lifecycle.Activated, Recorded: now})
+		}
+		if !lifecycle.Retired.IsZero() && !lifecycle.Retired.Equal(previous.Retired) {
+			events = append(events, KeyEvent{Type: KeyRetired, Time: lifecycle.Retired, Recorded: now})
+		}
+		add(key, events)
+	}
+
+	for _, key := range before {
+		if slices.ContainsFunc(after, func(other ManagedKey) bool { return other.JWK.KeyID == key.JWK.KeyID }) {
+			continue
+		}
+		if key.IsRemoved(now) {
+			add(key, []KeyEvent{{Type: KeyRemoved, Time: key.Lifecycle.Removed, Recorded: now}})
+		} else {
+			add(key, []KeyEvent{{Type: KeyRevoked, Time: now, Recorded: now}})
+		}
+	}
+	return histories
+}
+
+// recordKeyEvents appends the events between the keysets before and after a change to the key histories.
+// Errors are only logged, as the keys have already been stored.
+func (m *KeyManager) recordKeyEvents(ctx context.Context, before KeySet, after KeySet, now time.Time) {
+	for _, history := range keyEvents(m.KeyRing, before, after, now) {
+		err := m.Storage.AppendKeyEvents(ctx, history)
+		if err != nil {
+			log.Printf("Error when recording events of signing key %s in its history: %s", history.JWK.KeyID, err)
+		}
+	}
+}
+
+// recordMissingKeyHistories creates the history of all keys that do not have one yet, e.g. because they have been created by an older version
+func (m *KeyManager) recordMissingKeyHistories(ctx context.Context, keys KeySet, now time.Time) {
+	kids, err := m.Storage.ListKeyHistories(ctx)
+	if err != nil {
+		log.Printf("Error when listing key histories: %s", err)
+		return
+	}
+	missing := slices.DeleteFunc(slices.Clone(keys), func(key ManagedKey) bool { return slices.Contains(kids, key.JWK.KeyID) })
+	if len(missing) > 0 {
+		log.Printf("Recording history of %d signing keys without history", len(missing))
+		m.recordKeyEvents(ctx, nil, missing, now)
+	}
+}
+
+// LoadKeyHistories returns the histories of all keys, ordered by the time of their creation
+func LoadKeyHistories(ctx context.Context, store Storage) ([]KeyHistory, error) {
+	kids, err := store.ListKeyHistories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	histories := make([]KeyHistory, 0, len(kids))
+	for _, kid := range kids {
+		history, err := store.GetKeyHistory(ctx, kid)
+		if err != nil {
+			return nil, fmt.Errorf("error when reading history of key %s: %w", kid, err)
+		}
+		histories = append(histories, history)
+	}
+	slices.SortFunc(histories, func(a, b KeyHistory) int {
+		return a.created().Compare(b.created())
+	})
+	return histories, nil
+}
+
+// created returns the time of the first event of the history
+func (h KeyHistory) created() time.Time {
+	if len(h.Events) == 0 {
+		return time.Time{}
+	}
+	return h.Events[0].Time
+}
+
+// TokenVerification is the result of verifying a token against the key history
+type TokenVerification struct {
+	// Valid is set if the signature is valid and the key has been used for signing when the token has been issued
+	Valid    bool      `json:"valid"`
+	KeyID    string    `json:"kid,omitempty"`
+	KeyRing  string    `json:"keyRing,omitempty"`
+	IssuedAt time.Time `json:"issuedAt,omitzero"`
+	// KeyRevoked is when the key has been revoked, if it has been revoked
+	KeyRevoked time.Time              `json:"keyRevoked,omitzero"`
+	Claims     map[string]interface{} `json:"claims,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// VerifyWithKeyHistory verifies the signature of the token against the historical public key it has been signed with,
+// and checks that the key has been used for signing when the token has been issued. The expiry of the token is not checked.
+// Returns an error only if the key history could not be read.
+func VerifyWithKeyHistory(ctx context.Context, store Storage, token string) (TokenVerification, error) {
+	parsed, err := jwt.ParseSigned(token, supportedSignatureAlgorithms)
+	if err != nil {
+		return TokenVerification{Error: fmt.Sprintf("token can not be parsed: %s", err)}, nil
+	}
+	result := TokenVerification{
+		KeyID: parsed.Headers[0].KeyID,
+	}
+	// the kid is untrusted, as the signature has not been verified yet
+	if err := ValidateKeyID(result.KeyID); err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	history, err := store.GetKeyHistory(ctx, result.KeyID)
+	if err == ErrKeyHistoryNotFound {
+		result.Error = "token has not been signed by a known key"
+		return result, nil
+	}
+	if err != nil {
+		return TokenVerification{}, err
+	}
+	result.KeyRing = history.KeyRing
+	result.KeyRevoked = history.lastEvent(KeyRevoked)
+
+	claims := jwt.Claims{}
+	err = parsed.Claims(history.JWK.Key, &claims, &result.Claims)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid signature: %s", err)
+		return result, nil
+	}
+	if claims.IssuedAt == nil {
+		result.Error = "token has no iat claim"
+		return result, nil
+	}
+	result.IssuedAt = claims.IssuedAt.Time()
+	if !history.SignedAt(result.IssuedAt) {
+		result.Error = fmt.Sprintf("key %s has not been used for signing at %s", result.KeyID, result.IssuedAt)
+		return result, nil
+	}
+
+	result.Valid = true
+	return result, nil
+}
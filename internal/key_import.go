@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// minRSABits is the minimum modulus size accepted for imported RSA keys
+const minRSABits = 2048
+
+// ParsePrivateKey parses a private key in JWK or PEM (PKCS#1, PKCS#8 or SEC 1) format.
+// If algorithm is empty, the algorithm of the JWK or the default algorithm for the key type is used.
+// Keys from JWKs keep their kid, all other keys get their thumbprint as kid.
+func ParsePrivateKey(data []byte, algorithm string) (*jose.JSONWebKey, error) {
+	var key jose.JSONWebKey
+
+	block, _ := pem.Decode(data)
+	if block != nil {
+		privateKey, err := parsePEMPrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		key.Key = privateKey
+	} else {
+		err := json.Unmarshal(data, &key)
+		if err != nil {
+			return nil, fmt.Errorf("key is neither PEM nor JWK: %w", err)
+		}
+	}
+
+	if algorithm != "" {
+		key.Algorithm = algorithm
+	}
+	if key.Algorithm == "" {
+		key.Algorithm = defaultAlgorithmForKey(key.Key)
+	}
+	key.Use = "sign"
+
+	if key.KeyID == "" {
+		kid, err := thumbprint(key)
+		if err != nil {
+			return nil, err
+		}
+		key.KeyID = kid
+	}
+
+	return &key, ValidateSigningKey(key)
+}
+
+func parsePEMPrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+	}
+}
+
+func defaultAlgorithmForKey(key interface{}) string {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return string(jose.RS256)
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P384() {
+			return string(jose.ES384)
+		}
+		return string(jose.ES256)
+	case ed25519.PrivateKey:
+		return string(jose.EdDSA)
+	}
+	return ""
+}
+
+// ValidateSigningKey checks that the key is a private key that is suitable and strong enough for its algorithm
+func ValidateSigningKey(key jose.JSONWebKey) error {
+	if key.IsPublic() {
+		return fmt.Errorf("key %s is not a private key", key.KeyID)
+	}
+	if !key.Valid() {
+		return fmt.Errorf("key %s is invalid", key.KeyID)
+	}
+
+	switch jose.SignatureAlgorithm(key.Algorithm) {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256:
+		rsaKey, ok := key.Key.(*rsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an RSA key", key.Algorithm)
+		}
+		if rsaKey.N.BitLen() < minRSABits {
+			return fmt.Errorf("RSA key has %d bits, at least %d are required", rsaKey.N.BitLen(), minRSABits)
+		}
+	case jose.ES256, jose.ES384:
+		ecKey, ok := key.Key.(*ecdsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an EC key", key.Algorithm)
+		}
+		wantCurve := elliptic.P256()
+		if key.Algorithm == string(jose.ES384) {
+			wantCurve = elliptic.P384()
+		}
+		if ecKey.Curve != wantCurve {
+			return fmt.Errorf("algorithm %s requires curve %s, but key uses %s", key.Algorithm, wantCurve.Params().Name, ecKey.Curve.Params().Name)
+		}
+	case jose.EdDSA:
+		if _, ok := key.Key.(ed25519.PrivateKey); !ok {
+			return fmt.Errorf("algorithm %s requires an Ed25519 key", key.Algorithm)
+		}
+	default:
+		return fmt.Errorf("unsupported signing algorithm %s", key.Algorithm)
+	}
+	return nil
+}
@@ -2,25 +2,74 @@ package internal
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"log"
 	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-jose/go-jose/v4"
+	"github.com/robfig/cron/v3"
 )
 
+// KeyManager manages the signing keys of a single key ring
 type KeyManager struct {
-	Storage           Storage
-	TokenGenerator    *TokenGenerator
+	Storage        Storage
+	TokenGenerator *TokenGenerator
+	// KeyRing is the name of the managed key ring
+	KeyRing string
+	// KeyLocation is where the keys of the key ring are stored
+	KeyLocation       string
 	KeyRotationPeriod time.Duration
-	KeyMaxAge         time.Duration
+	// KeyRotationSchedule limits the times keys are rotated at. If nil, keys are rotated as soon as they are due
+	KeyRotationSchedule cron.Schedule
+	KeyMaxAge           time.Duration
+	// KeyPrePublishPeriod is how long new keys are published in the JWKS before they are used for signing
+	KeyPrePublishPeriod time.Duration
+	// KeyAlgorithms are the signature-algorithms to maintain an active key for
+	KeyAlgorithms []string
+	// KeyBits is the modulus size for newly generated RSA keys
+	KeyBits int
+	// Reissuer is notified about revoked keys, so tokens signed by them can be reissued
+	Reissuer Reissuer
+	// CertificateIssuer mints a certificate for every key. No certificates are published if nil
+	CertificateIssuer *CertificateIssuer
+	// KeyBackend holds the private keys. Defaults to MemoryKeyBackend if nil
+	KeyBackend KeyBackend
+
+	// uncommitted are the kids of generated keys whose store failed, but may have been stored nevertheless
+	uncommitted map[string]bool
+	// generatorVersion is the version of the keys the TokenGenerator has last been configured with
+	generatorVersion int64
+	lock             sync.Mutex
+}
+
+// keyBackend returns the configured KeyBackend, or MemoryKeyBackend if there is none
+func (m *KeyManager) keyBackend() KeyBackend {
+	if m.KeyBackend == nil {
+		return MemoryKeyBackend{}
+	}
+	return m.KeyBackend
+}
+
+// Reissuer reissues tokens on request
+type Reissuer interface {
+	// ReissueTokensSignedBy reissues all tokens that have been signed by one of the given keys
+	ReissueTokensSignedBy(kids ...string)
+	// KeysChanged notifies the Reissuer that the keys or their scheduled removals have changed
+	KeysChanged()
 }
 
-func (m KeyManager) Manage(ctx context.Context) error {
+func (m *KeyManager) Manage(ctx context.Context) error {
 	for {
 		next, err := m.ManageOnce(ctx)
 		if err != nil {
@@ -33,139 +82,500 @@ func (m KeyManager) Manage(ctx context.Context) error {
 	}
 }
 
-func (m KeyManager) ManageOnce(ctx context.Context) (time.Time, error) {
+// maxConflictRetries is how often ManageOnce reloads the keys and retries when they have been modified concurrently
+const maxConflictRetries = 5
 
-	log.Print("Checking keys")
-	errRetryTime := time.Now().Add(10 * time.Minute)
+// ManageOnce checks the stored keys, rotates and deletes keys if necessary and returns the time it should be run again.
+// If the stored keys are modified concurrently, the keys are reloaded and the check is retried.
+func (m *KeyManager) ManageOnce(ctx context.Context) (time.Time, error) {
+	for attempt := 1; ; attempt++ {
+		nextRun, err := m.manageOnce(ctx)
+		if errors.Is(err, ErrKeysVersionConflict) && attempt < maxConflictRetries {
+			log.Println("Signing keys have been modified concurrently. Reloading and retrying")
+			continue
+		}
+		return nextRun, err
+	}
+}
 
-	currentKeys, existing, err := LoadOrGenerateAndStoreKeys(ctx, m.Storage)
-	if err != nil {
-		return errRetryTime, err
+func (m *KeyManager) manageOnce(ctx context.Context) (time.Time, error) {
+
+	if m.KeyRing == DefaultKeyRing {
+		log.Print("Checking keys")
+	} else {
+		log.Printf("Checking keys of key ring %s", m.KeyRing)
 	}
+	errRetryTime := time.Now().Add(10 * time.Minute)
 
-	newestKey := findNewestKey(currentKeys)
-	newestKeyCreatedAt, err := getKeyCreationTime(*newestKey)
+	currentKeys, version, existing, err := LoadOrGenerateAndStoreKeys(ctx, m.Storage, m.keyBackend(), m.KeyLocation, m.KeyAlgorithms, m.KeyBits)
 	if err != nil {
+		m.discardGeneratedKeys(currentKeys, nil, err)
 		return errRetryTime, err
 	}
+	m.cleanupUncommittedKeys(currentKeys)
+	now := time.Now()
 
 	if !existing {
-		log.Println("No existing signing keys found. Generated new key:", newestKey.KeyID)
+		log.Println("No existing signing keys found. Generated new keys")
 	}
 
-	if m.TokenGenerator != nil {
-		m.TokenGenerator.SetKey(*newestKey)
-	}
-
-	keysChanged := false
-	var nextRun time.Time
+	m.checkBackendKeys(currentKeys, now)
+	keysChanged := migrateLegacyKeys(currentKeys, m.KeyMaxAge)
+	loadedKeys := slices.Clone(currentKeys)
+	m.recordMissingKeyHistories(ctx, currentKeys, now)
+	nextRun := now.Add(m.KeyRotationPeriod)
 
-	if time.Now().Sub(newestKeyCreatedAt) > m.KeyRotationPeriod {
-		log.Println("Generating new signing key")
+	// retire active and upcoming keys of algorithms that are no longer configured
+	for i := range currentKeys {
+		if currentKeys[i].Lifecycle.Retired.IsZero() && !slices.Contains(m.KeyAlgorithms, currentKeys[i].JWK.Algorithm) {
+			log.Printf("Retiring signing key %s, as %s is no longer configured", currentKeys[i].JWK.KeyID, currentKeys[i].JWK.Algorithm)
+			m.retire(&currentKeys[i], now)
+			keysChanged = true
+		}
+	}
 
-		newKey, err := GenerateNewKey()
+	for _, algorithm := range m.KeyAlgorithms {
+		next, changed, err := m.rotateIfNecessary(&currentKeys, algorithm, now)
 		if err != nil {
+			m.deleteBackendKeys(currentKeys, loadedKeys)
 			return errRetryTime, err
 		}
-
-		currentKeys.Keys = append(currentKeys.Keys, *newKey)
-		newestKey = newKey
-		keysChanged = true
-		nextRun = time.Now().Add(m.KeyRotationPeriod)
-	} else {
-		nextRun = newestKeyCreatedAt.Add(m.KeyRotationPeriod)
+		keysChanged = keysChanged || changed
+		if next.Before(nextRun) {
+			nextRun = next
+		}
 	}
 
-	currentKeys.Keys = slices.DeleteFunc(currentKeys.Keys, func(key jose.JSONWebKey) bool {
-		createdAt, err := getKeyCreationTime(key)
-		if err != nil {
-			return false
-		}
-		if time.Now().Sub(createdAt) > m.KeyMaxAge {
-			log.Println("Deleting outdated signing key", key.KeyID)
+	currentKeys = slices.DeleteFunc(currentKeys, func(key ManagedKey) bool {
+		if key.IsRemoved(now) {
+			log.Println("Deleting outdated signing key", key.JWK.KeyID)
 			keysChanged = true
 			return true
-		} else {
-			deletionSheduledFor := createdAt.Add(m.KeyMaxAge)
-			if deletionSheduledFor.Before(nextRun) {
-				nextRun = deletionSheduledFor
-			}
+		}
+		if !key.Lifecycle.Removed.IsZero() && key.Lifecycle.Removed.Before(nextRun) {
+			nextRun = key.Lifecycle.Removed
 		}
 		return false
 	})
 
+	certificatesChanged, err := m.ensureCertificates(currentKeys)
+	if err != nil {
+		m.deleteBackendKeys(currentKeys, loadedKeys)
+		return errRetryTime, err
+	}
+	keysChanged = keysChanged || certificatesChanged
+
 	if keysChanged {
-		err = m.Storage.StoreKeys(ctx, currentKeys)
+		err = m.Storage.StoreKeys(ctx, m.KeyLocation, currentKeys, version)
 		if err != nil {
+			m.discardGeneratedKeys(currentKeys, loadedKeys, err)
 			return errRetryTime, err
 		}
-		if m.TokenGenerator != nil {
-			m.TokenGenerator.SetKey(*newestKey)
+		version++
+		m.deleteBackendKeys(loadedKeys, currentKeys)
+		m.recordKeyEvents(ctx, loadedKeys, currentKeys, now)
+	} else {
+		// the keys have not been checked by StoreKeys, so make sure they have not been modified since they have been loaded
+		_, storedVersion, err := m.Storage.GetKeys(ctx, m.KeyLocation)
+		if err != nil {
+			return errRetryTime, err
+		}
+		if storedVersion != version {
+			return errRetryTime, ErrKeysVersionConflict
 		}
 	}
 
+	m.updateTokenGenerator(ctx, currentKeys, version, now)
+
 	return nextRun, nil
 }
 
-func LoadOrGenerateAndStoreKeys(ctx context.Context, store Storage) (jose.JSONWebKeySet, bool, error) {
-	signingKeys, err := store.GetKeys(ctx)
-	if err != nil && err != ErrNoKeysFound {
-		return jose.JSONWebKeySet{}, false, fmt.Errorf("error when trying to fetch existing keys: %w", err)
+// updateTokenGenerator configures the TokenGenerator with the keys that are active at the given time, the published keys and the scheduled removals of all keys.
+// version is the stored version of keys. Keys older than the ones the TokenGenerator has already been configured with are ignored,
+// unless the stored keys have been deleted and recreated since, which restarts their versions.
+func (m *KeyManager) updateTokenGenerator(ctx context.Context, keys KeySet, version int64, now time.Time) {
+	if m.TokenGenerator == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if version < m.generatorVersion {
+		// a concurrent update of the keys has overtaken this one, unless the stored version is lower as well
+		_, storedVersion, err := m.Storage.GetKeys(ctx, m.KeyLocation)
+		if err != nil && err != ErrNoKeysFound {
+			log.Printf("Error when checking the version of the signing keys at %s: %s", m.KeyLocation, err)
+			return
+		}
+		if storedVersion >= m.generatorVersion {
+			return
+		}
+		log.Printf("Signing keys at %s have been recreated, their version restarted at %d", m.KeyLocation, storedVersion)
+	}
+	m.generatorVersion = version
+	activeKeys := make(map[string]SigningKey, len(m.KeyAlgorithms))
+	for _, algorithm := range m.KeyAlgorithms {
+		active := keys.ActiveKey(algorithm, now)
+		if active == -1 {
+			continue
+		}
+		signer, err := m.keyBackend().Signer(keys[active].JWK)
+		if err != nil {
+			log.Printf("Signing key %s can not be used for signing: %s", keys[active].JWK.KeyID, err)
+			continue
+		}
+		activeKeys[algorithm] = SigningKey{
+			JWK:    keys[active].JWK.Public(),
+			Signer: signer,
+		}
 	}
+	m.TokenGenerator.SetKeys(m.KeyRing, activeKeys)
+	m.TokenGenerator.SetPublishedKeys(m.KeyRing, keys.PublicJWKS(now).Keys)
 
-	if len(signingKeys.Keys) == 0 {
-		key, err := GenerateNewKey()
+	removals := make(map[string]time.Time)
+	for _, key := range keys {
+		if !key.Lifecycle.Removed.IsZero() {
+			removals[key.JWK.KeyID] = key.Lifecycle.Removed
+		}
+	}
+	m.TokenGenerator.SetScheduledRemovals(m.KeyRing, removals)
+
+	if m.Reissuer != nil {
+		m.Reissuer.KeysChanged()
+	}
+}
+
+// rotateIfNecessary makes sure there is an active key for the algorithm. If the active key is due for rotation,
+// its successor is generated and published KeyPrePublishPeriod before it becomes active.
+// Returns the time of the next phase transition and whether the keys have been changed.
+func (m *KeyManager) rotateIfNecessary(keys *KeySet, algorithm string, now time.Time) (time.Time, bool, error) {
+	active := keys.ActiveKey(algorithm, now)
+	upcoming := keys.UpcomingKey(algorithm, now)
+
+	if active == -1 && upcoming != -1 {
+		log.Printf("No active %s signing key, activating upcoming key %s", algorithm, (*keys)[upcoming].JWK.KeyID)
+		(*keys)[upcoming].Lifecycle.Activated = now
+		return now.Add(m.KeyRotationPeriod - m.KeyPrePublishPeriod), true, nil
+	}
+
+	if active == -1 {
+		log.Printf("Generating new %s signing key", algorithm)
+		newKey, err := generateManagedKey(m.keyBackend(), algorithm, m.KeyBits, now, now)
 		if err != nil {
-			return jose.JSONWebKeySet{}, false, fmt.Errorf("error when trying to generate new key: %w", err)
+			return time.Time{}, false, err
 		}
-		signingKeys.Keys = append(signingKeys.Keys, *key)
-		err = store.StoreKeys(ctx, signingKeys)
+		log.Printf("Activating signing key %s", newKey.JWK.KeyID)
+		*keys = append(*keys, newKey)
+		return now.Add(m.KeyRotationPeriod - m.KeyPrePublishPeriod), true, nil
+	}
+
+	if upcoming != -1 {
+		return (*keys)[upcoming].Lifecycle.Activated, false, nil
+	}
+
+	rotateAt, outsideSchedule := m.rotationTime((*keys)[active])
+	publishAt := rotateAt.Add(-m.KeyPrePublishPeriod)
+	if now.Before(publishAt) {
+		return publishAt, false, nil
+	}
+
+	activateAt := now.Add(m.KeyPrePublishPeriod)
+	if rotateAt.After(activateAt) {
+		activateAt = rotateAt
+	}
+
+	if outsideSchedule {
+		log.Printf("Rotating %s signing key %s outside of the rotation schedule, as it reaches its max age", algorithm, (*keys)[active].JWK.KeyID)
+	}
+	log.Printf("Generating new %s signing key", algorithm)
+	newKey, err := generateManagedKey(m.keyBackend(), algorithm, m.KeyBits, now, activateAt)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	log.Printf("Publishing signing key %s, it will become active at %s", newKey.JWK.KeyID, activateAt)
+	log.Printf("Retiring signing key %s at %s", (*keys)[active].JWK.KeyID, activateAt)
+	m.retire(&(*keys)[active], activateAt)
+	*keys = append(*keys, newKey)
+	return activateAt, true, nil
+}
+
+// rotationTime returns when the key is replaced. Keys are due KeyRotationPeriod after their activation, or once their pin expires.
+// With a KeyRotationSchedule, the rotation happens at the next time matching the schedule. Keys are removed KeyMaxAge - KeyRotationPeriod -
+// KeyPrePublishPeriod after their retirement, so the rotation is only deferred until KeyRotationPeriod + KeyPrePublishPeriod after the creation
+// of the key. If the schedule has no matching time until then, the key is rotated at the last matching time before it, or outside of the
+// schedule if there is none. Returns whether the rotation could not be scheduled within the schedule.
+func (m *KeyManager) rotationTime(key ManagedKey) (time.Time, bool) {
+	due := key.Lifecycle.Activated.Add(m.KeyRotationPeriod)
+	if key.Lifecycle.PinnedUntil.After(due) {
+		due = key.Lifecycle.PinnedUntil
+	}
+	if m.KeyRotationSchedule == nil {
+		return due, false
+	}
+
+	deadline := key.Lifecycle.Created.Add(m.KeyRotationPeriod + m.KeyPrePublishPeriod)
+	if deadline.Before(due) {
+		deadline = due
+	}
+	scheduled := m.KeyRotationSchedule.Next(due.Add(-time.Second))
+	if !scheduled.IsZero() && !scheduled.After(deadline) {
+		return scheduled, false
+	}
+	if earlier := lastScheduledBefore(m.KeyRotationSchedule, key.Lifecycle.Activated, deadline); !earlier.IsZero() {
+		return earlier, false
+	}
+	return deadline, true
+}
+
+// lastScheduledBefore returns the last time matching the schedule in (from, until], or zero if there is none
+func lastScheduledBefore(schedule cron.Schedule, from time.Time, until time.Time) time.Time {
+	first := schedule.Next(from)
+	if first.IsZero() || first.After(until) {
+		return time.Time{}
+	}
+	// search for the latest start whose next matching time is still in time. Schedules have a precision of seconds.
+	low, high := from, until
+	for high.Sub(low) > time.Second {
+		middle := low.Add(high.Sub(low) / 2)
+		if next := schedule.Next(middle); !next.IsZero() && !next.After(until) {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+	return schedule.Next(low)
+}
+
+// retire stops the key from being used for signing at the given time and schedules its removal from the JWKS.
+// The key is removed after key.maxAge, but stays published at least as long after its retirement as a regularly rotated key would.
+func (m *KeyManager) retire(key *ManagedKey, at time.Time) {
+	key.Lifecycle.Retired = at
+	key.Lifecycle.Removed = key.Lifecycle.Created.Add(m.KeyMaxAge)
+	gracePeriod := m.KeyMaxAge - m.KeyRotationPeriod - m.KeyPrePublishPeriod
+	if minRemoval := at.Add(gracePeriod); key.Lifecycle.Removed.Before(minRemoval) {
+		key.Lifecycle.Removed = minRemoval
+	}
+}
+
+// ensureCertificates makes sure every key has a certificate from the CertificateIssuer that is valid until the key is removed.
+// Returns whether any certificate has been issued.
+func (m *KeyManager) ensureCertificates(keys KeySet) (bool, error) {
+	if m.CertificateIssuer == nil {
+		return false, nil
+	}
+	changed := false
+	for i := range keys {
+		lifecycle := keys[i].Lifecycle
+		notAfter := lifecycle.Removed
+		if notAfter.IsZero() {
+			notAfter = lifecycle.Created
+			if lifecycle.PinnedUntil.After(notAfter) {
+				notAfter = lifecycle.PinnedUntil
+			}
+			notAfter = notAfter.Add(m.KeyMaxAge)
+		}
+		if !m.CertificateIssuer.NeedsCertificate(keys[i].JWK, notAfter) {
+			continue
+		}
+		signer, err := m.keyBackend().Signer(keys[i].JWK)
 		if err != nil {
-			return jose.JSONWebKeySet{}, false, fmt.Errorf("error when trying to store newly generated key: %w", err)
+			return false, err
 		}
-		return signingKeys, false, nil
+		err = m.CertificateIssuer.Issue(&keys[i].JWK, signer, lifecycle.Created, notAfter)
+		if err != nil {
+			return false, err
+		}
+		log.Printf("Issued certificate for signing key %s, valid until %s", keys[i].JWK.KeyID, notAfter)
+		changed = true
 	}
+	return changed, nil
+}
 
-	return signingKeys, true, nil
+// checkBackendKeys logs all published keys whose private key is neither part of the keyset nor held by the KeyBackend
+func (m *KeyManager) checkBackendKeys(keys KeySet, now time.Time) {
+	backendKeys, err := m.keyBackend().PublicKeys()
+	if err != nil {
+		log.Printf("Error when listing the keys of the key backend: %s", err)
+		return
+	}
+	for _, key := range keys {
+		if key.IsRemoved(now) || !key.JWK.IsPublic() {
+			continue
+		}
+		if !slices.ContainsFunc(backendKeys, func(backendKey jose.JSONWebKey) bool { return backendKey.KeyID == key.JWK.KeyID }) {
+			log.Printf("Private key of signing key %s is missing in the key backend", key.JWK.KeyID)
+		}
+	}
+}
+
+// deleteBackendKeys deletes the private keys of all keys that are not part of remaining from the KeyBackend.
+// Errors are only logged, as the keys are no longer used anyway.
+func (m *KeyManager) deleteBackendKeys(keys KeySet, remaining KeySet) {
+	for _, key := range keys {
+		if slices.ContainsFunc(remaining, func(other ManagedKey) bool { return other.JWK.KeyID == key.JWK.KeyID }) {
+			continue
+		}
+		if err := m.keyBackend().DeleteKey(key.JWK.KeyID); err != nil {
+			log.Printf("Error when deleting private key of signing key %s: %s", key.JWK.KeyID, err)
+		}
+	}
 }
 
-func GenerateNewKey() (*jose.JSONWebKey, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+// discardGeneratedKeys deletes the private keys of all keys that are not part of loadedKeys, after storing keys failed with err.
+// Only a version conflict guarantees that the keys have not been stored. After other errors the keys are remembered instead,
+// and deleted by cleanupUncommittedKeys once the stored keys show that they have not been stored.
+func (m *KeyManager) discardGeneratedKeys(keys KeySet, loadedKeys KeySet, err error) {
+	if errors.Is(err, ErrKeysVersionConflict) {
+		m.deleteBackendKeys(keys, loadedKeys)
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, key := range keys {
+		if slices.ContainsFunc(loadedKeys, func(other ManagedKey) bool { return other.JWK.KeyID == key.JWK.KeyID }) {
+			continue
+		}
+		if m.uncommitted == nil {
+			m.uncommitted = make(map[string]bool)
+		}
+		m.uncommitted[key.JWK.KeyID] = true
+	}
+}
+
+// cleanupUncommittedKeys deletes the private keys remembered by discardGeneratedKeys that are not part of the stored keys
+func (m *KeyManager) cleanupUncommittedKeys(stored KeySet) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for kid := range m.uncommitted {
+		if !slices.ContainsFunc(stored, func(key ManagedKey) bool { return key.JWK.KeyID == kid }) {
+			log.Printf("Signing key %s has not been stored. Deleting its private key", kid)
+			if err := m.keyBackend().DeleteKey(kid); err != nil {
+				log.Printf("Error when deleting private key of signing key %s: %s", kid, err)
+				continue
+			}
+		}
+		delete(m.uncommitted, kid)
+	}
+}
+
+// LoadOrGenerateAndStoreKeys loads the keys stored at location and their version. If there are no keys, a new key per algorithm is generated
+// by backend and stored. If storing the new keys fails, they are returned together with the error.
+func LoadOrGenerateAndStoreKeys(ctx context.Context, store Storage, backend KeyBackend, location string, algorithms []string, bits int) (KeySet, int64, bool, error) {
+	signingKeys, version, err := store.GetKeys(ctx, location)
+	if err != nil && err != ErrNoKeysFound {
+		return nil, 0, false, fmt.Errorf("error when trying to fetch existing keys: %w", err)
+	}
+
+	if len(signingKeys) == 0 {
+		now := time.Now()
+		for _, algorithm := range algorithms {
+			key, err := generateManagedKey(backend, algorithm, bits, now, now)
+			if err != nil {
+				return nil, 0, false, fmt.Errorf("error when trying to generate new key: %w", err)
+			}
+			signingKeys = append(signingKeys, key)
+		}
+		err = store.StoreKeys(ctx, location, signingKeys, version)
+		if err != nil {
+			return signingKeys, 0, false, fmt.Errorf("error when trying to store newly generated key: %w", err)
+		}
+		return signingKeys, version + 1, false, nil
+	}
+
+	return signingKeys, version, true, nil
+}
+
+// GenerateNewKey generates a new signing key for the given algorithm. bits is only used for RSA keys.
+// The key-id is the RFC 7638 thumbprint of the key.
+func GenerateNewKey(algorithm string, bits int) (*jose.JSONWebKey, error) {
+	var privateKey crypto.PrivateKey
+	var err error
+
+	switch jose.SignatureAlgorithm(algorithm) {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, bits)
+	case jose.ES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.ES384:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jose.EdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %s", algorithm)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &jose.JSONWebKey{
-		KeyID:     generateKID(),
-		Algorithm: "RS256",
+	key := &jose.JSONWebKey{
+		Algorithm: algorithm,
 		Key:       privateKey,
 		Use:       "sign",
-	}, nil
-}
-
-func generateKID() string {
-	return strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	key.KeyID, err = thumbprint(*key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
-func getKeyCreationTime(key jose.JSONWebKey) (time.Time, error) {
-	newestKeyUnixTime, err := strconv.ParseInt(key.KeyID, 10, 64)
+// generateManagedKey generates a new key with the backend that becomes active at activateAt
+func generateManagedKey(backend KeyBackend, algorithm string, bits int, now time.Time, activateAt time.Time) (ManagedKey, error) {
+	key, err := backend.GenerateKey(algorithm, bits)
 	if err != nil {
-		return time.Time{}, err
+		return ManagedKey{}, err
 	}
-	return time.Unix(newestKeyUnixTime, 0), nil
+	return ManagedKey{
+		JWK: key,
+		Lifecycle: KeyLifecycle{
+			Created:   now,
+			Activated: activateAt,
+		},
+	}, nil
 }
 
-func findNewestKey(jwks jose.JSONWebKeySet) *jose.JSONWebKey {
-	var newestKey *jose.JSONWebKey
-	var highestKeyID string
+// migrateLegacyKeys fills in the lifecycle metadata of keys that have been stored with a timestamp as key-id and without metadata.
+// The key-ids are kept, so tokens signed by these keys remain verifiable. Returns whether any key has been migrated.
+func migrateLegacyKeys(keys KeySet, maxAge time.Duration) bool {
+	legacy := make([]int, 0)
+	for i := range keys {
+		if !keys[i].Lifecycle.Created.IsZero() {
+			continue
+		}
+		createdAt, err := getLegacyKeyCreationTime(keys[i].JWK)
+		if err != nil {
+			log.Printf("Could not determine creation time of signing key %s: %s", keys[i].JWK.KeyID, err)
+			createdAt = time.Now()
+		}
+		keys[i].Lifecycle.Created = createdAt
+		keys[i].Lifecycle.Activated = createdAt
+		legacy = append(legacy, i)
+	}
+	if len(legacy) == 0 {
+		return false
+	}
 
-	for _, jwk := range jwks.Keys {
-		key := jwk
-		if highestKeyID == "" || key.KeyID > highestKeyID {
-			newestKey = &key
-			highestKeyID = key.KeyID
+	// legacy keys did not track retirement. Every key except the newest per algorithm has been retired by its successor
+	for _, i := range legacy {
+		for j := range keys {
+			if keys[j].JWK.Algorithm != keys[i].JWK.Algorithm || !keys[j].Lifecycle.Created.After(keys[i].Lifecycle.Created) {
+				continue
+			}
+			if keys[i].Lifecycle.Retired.IsZero() || keys[j].Lifecycle.Created.Before(keys[i].Lifecycle.Retired) {
+				keys[i].Lifecycle.Retired = keys[j].Lifecycle.Created
+				keys[i].Lifecycle.Removed = keys[i].Lifecycle.Created.Add(maxAge)
+			}
 		}
 	}
+	log.Printf("Migrated %d signing keys without lifecycle metadata", len(legacy))
+	return true
+}
 
-	return newestKey
+// getLegacyKeyCreationTime parses the creation time from key-ids in the legacy format <unix-timestamp>[-<algorithm>]
+func getLegacyKeyCreationTime(key jose.JSONWebKey) (time.Time, error) {
+	timestamp, _, _ := strings.Cut(key.KeyID, "-")
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unixTime, 0), nil
 }
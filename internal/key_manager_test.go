@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduledRotationEnforcesMaxAge(t *testing.T) {
+	monday := time.Date(2026, 3, 2, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name            string
+		schedule        string
+		prePublish      time.Duration
+		created         time.Time
+		outsideSchedule bool
+	}{
+		{name: "yearly", schedule: "@yearly", outsideSchedule: true},
+		{name: "yearly pre-published", schedule: "@yearly", prePublish: 10 * time.Minute, outsideSchedule: true},
+		{name: "business hours", schedule: "* 9-15 * * 1-5"},
+		{name: "business hours pre-published", schedule: "* 9-15 * * 1-5", prePublish: 10 * time.Minute},
+		{name: "hourly", schedule: "0 * * * *", prePublish: 10 * time.Minute},
+		// due after the window closes, so the key is rotated at the end of the window
+		{name: "business hours closing", schedule: "* 9-15 * * 1-5", created: monday.Add(5 * time.Hour)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseRotationSchedule(test.schedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &KeyManager{
+				KeyRotationPeriod:   time.Hour,
+				KeyRotationSchedule: schedule,
+				KeyMaxAge:           3 * time.Hour,
+				KeyPrePublishPeriod: test.prePublish,
+			}
+			created := monday
+			if !test.created.IsZero() {
+				created = test.created
+			}
+			key := ManagedKey{Lifecycle: KeyLifecycle{Created: created, Activated: created.Add(test.prePublish)}}
+
+			rotateAt, outsideSchedule := m.rotationTime(key)
+			if outsideSchedule != test.outsideSchedule {
+				t.Errorf("expected outsideSchedule to be %t", test.outsideSchedule)
+			}
+			if !outsideSchedule && schedule.Next(rotateAt.Add(-time.Second)) != rotateAt {
+				t.Errorf("rotation at %s does not match the schedule", rotateAt)
+			}
+			if !rotateAt.After(key.Lifecycle.Activated) {
+				t.Errorf("rotation at %s is not after the activation at %s", rotateAt, key.Lifecycle.Activated)
+			}
+
+			m.retire(&key, rotateAt)
+			if age := key.Lifecycle.Removed.Sub(key.Lifecycle.Created); age > m.KeyMaxAge {
+				t.Errorf("key is removed %s after its creation, which exceeds the max age of %s", age, m.KeyMaxAge)
+			}
+			if grace := key.Lifecycle.Removed.Sub(rotateAt); grace < m.KeyMaxAge-m.KeyRotationPeriod-m.KeyPrePublishPeriod {
+				t.Errorf("key is only published for %s after its retirement", grace)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+var ErrKeyNotFound = errors.New("signing key not found")
+
+// Rotate immediately replaces the active key for the given algorithm, or for all algorithms if algorithm is empty.
+// An already published upcoming key is activated, otherwise a new key is generated.
+func (m *KeyManager) Rotate(ctx context.Context, algorithm string) error {
+	algorithms := m.KeyAlgorithms
+	if algorithm != "" {
+		if !slices.Contains(m.KeyAlgorithms, algorithm) {
+			return fmt.Errorf("algorithm %s is not configured", algorithm)
+		}
+		algorithms = []string{algorithm}
+	}
+
+	return m.updateKeys(ctx, func(keys *KeySet, now time.Time) error {
+		for _, algorithm := range algorithms {
+			if active := keys.ActiveKey(algorithm, now); active != -1 {
+				log.Printf("Manual rotation: retiring signing key %s", (*keys)[active].JWK.KeyID)
+				m.retire(&(*keys)[active], now)
+			}
+			if err := m.activateReplacement(keys, algorithm, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Retire immediately stops using the key with the given kid for signing. It stays in the JWKS until its scheduled removal.
+func (m *KeyManager) Retire(ctx context.Context, kid string) error {
+	return m.updateKeys(ctx, func(keys *KeySet, now time.Time) error {
+		i := slices.IndexFunc(*keys, func(key ManagedKey) bool { return key.JWK.KeyID == kid })
+		if i == -1 {
+			return ErrKeyNotFound
+		}
+		if (*keys)[i].IsRetired(now) {
+			log.Printf("Manual retirement: signing key %s has already been retired", kid)
+			return nil
+		}
+
+		log.Printf("Manual retirement: retiring signing key %s", kid)
+		m.retire(&(*keys)[i], now)
+		algorithm := (*keys)[i].JWK.Algorithm
+		if slices.Contains(m.KeyAlgorithms, algorithm) && keys.ActiveKey(algorithm, now) == -1 {
+			return m.activateReplacement(keys, algorithm, now)
+		}
+		return nil
+	})
+}
+
+// Revoke removes the key with the given kid from the JWKS right away and reissues all tokens signed by it
+func (m *KeyManager) Revoke(ctx context.Context, kid string) error {
+	err := m.updateKeys(ctx, func(keys *KeySet, now time.Time) error {
+		i := slices.IndexFunc(*keys, func(key ManagedKey) bool { return key.JWK.KeyID == kid })
+		if i == -1 {
+			return ErrKeyNotFound
+		}
+
+		log.Printf("Revoking signing key %s", kid)
+		algorithm := (*keys)[i].JWK.Algorithm
+		*keys = slices.Delete(*keys, i, i+1)
+		if slices.Contains(m.KeyAlgorithms, algorithm) && keys.ActiveKey(algorithm, now) == -1 {
+			return m.activateReplacement(keys, algorithm, now)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if m.Reissuer != nil {
+		log.Printf("Reissuing all tokens signed by revoked key %s", kid)
+		m.Reissuer.ReissueTokensSignedBy(kid)
+	}
+	return nil
+}
+
+// Import adds an existing private key to the keyset and activates it right away, replacing the active key for its algorithm.
+// If pinnedUntil is set, the key is not rotated before that time.
+func (m *KeyManager) Import(ctx context.Context, key jose.JSONWebKey, pinnedUntil time.Time) error {
+	err := ValidateSigningKey(key)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(m.KeyAlgorithms, key.Algorithm) {
+		return fmt.Errorf("algorithm %s of the imported key is not configured", key.Algorithm)
+	}
+
+	return m.updateKeys(ctx, func(keys *KeySet, now time.Time) error {
+		if slices.ContainsFunc(*keys, func(existing ManagedKey) bool { return existing.JWK.KeyID == key.KeyID }) {
+			return fmt.Errorf("a key with kid %s already exists", key.KeyID)
+		}
+
+		if active := keys.ActiveKey(key.Algorithm, now); active != -1 {
+			log.Printf("Import: retiring signing key %s", (*keys)[active].JWK.KeyID)
+			m.retire(&(*keys)[active], now)
+		}
+		if upcoming := keys.UpcomingKey(key.Algorithm, now); upcoming != -1 {
+			log.Printf("Import: retiring upcoming signing key %s", (*keys)[upcoming].JWK.KeyID)
+			m.retire(&(*keys)[upcoming], now)
+		}
+
+		if pinnedUntil.IsZero() {
+			log.Printf("Importing and activating signing key %s", key.KeyID)
+		} else {
+			log.Printf("Importing and activating signing key %s, pinned until %s", key.KeyID, pinnedUntil)
+		}
+		stored, err := m.keyBackend().ImportKey(key)
+		if err != nil {
+			return err
+		}
+		*keys = append(*keys, ManagedKey{
+			JWK: stored,
+			Lifecycle: KeyLifecycle{
+				Created:     now,
+				Activated:   now,
+				Imported:    true,
+				PinnedUntil: pinnedUntil,
+			},
+		})
+		return nil
+	})
+}
+
+// activateReplacement activates the upcoming key for the algorithm right away, or generates a new active key if there is none
+func (m *KeyManager) activateReplacement(keys *KeySet, algorithm string, now time.Time) error {
+	if upcoming := keys.UpcomingKey(algorithm, now); upcoming != -1 {
+		log.Printf("Activating upcoming signing key %s", (*keys)[upcoming].JWK.KeyID)
+		(*keys)[upcoming].Lifecycle.Activated = now
+		return nil
+	}
+
+	newKey, err := generateManagedKey(m.keyBackend(), algorithm, m.KeyBits, now, now)
+	if err != nil {
+		return err
+	}
+	log.Printf("Activating new signing key %s", newKey.JWK.KeyID)
+	*keys = append(*keys, newKey)
+	return nil
+}
+
+// updateKeys loads the keys, applies modify and stores the result. Retries if the keys have been modified concurrently.
+func (m *KeyManager) updateKeys(ctx context.Context, modify func(keys *KeySet, now time.Time) error) error {
+	for attempt := 1; ; attempt++ {
+		keys, version, err := m.Storage.GetKeys(ctx, m.KeyLocation)
+		if err != nil {
+			return err
+		}
+		loadedKeys := slices.Clone(keys)
+		m.cleanupUncommittedKeys(keys)
+		now := time.Now()
+
+		err = modify(&keys, now)
+		if err == nil {
+			_, err = m.ensureCertificates(keys)
+		}
+		if err != nil {
+			// discard keys that have been generated for the failed modification
+			m.deleteBackendKeys(keys, loadedKeys)
+			return err
+		}
+		err = m.Storage.StoreKeys(ctx, m.KeyLocation, keys, version)
+		if err != nil {
+			m.discardGeneratedKeys(keys, loadedKeys, err)
+		}
+		if errors.Is(err, ErrKeysVersionConflict) && attempt < maxConflictRetries {
+			log.Println("Signing keys have been modified concurrently. Reloading and retrying")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		m.deleteBackendKeys(loadedKeys, keys)
+		m.recordKeyEvents(ctx, loadedKeys, keys, now)
+
+		m.updateTokenGenerator(ctx, keys, version+1, now)
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// DefaultKeyRing is the name of the key ring used for all tokens that are not assigned to another key ring
+const DefaultKeyRing = ""
+
+// defaultKeyLocation is where the keys of the default key ring are stored
+const defaultKeyLocation = "keys"
+
+var ErrKeyRingNotFound = errors.New("key ring not found")
+
+var keyRingNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// KeyRingConfig configures an isolated set of signing keys with its own rotation schedule and storage location
+type KeyRingConfig struct {
+	Name string
+	// Teams whose tokens are signed with this key ring, unless their TokenConfig selects another key ring
+	Teams []string
+	// Path is where the keys are stored, relative to the config-path of the storage-backend. Defaults to keyrings/<name>
+	Path string
+	// RotationPeriod, RotationSchedule, MaxAge and PrePublishPeriod default to the corresponding key.* settings
+	RotationPeriod   time.Duration
+	RotationSchedule string
+	MaxAge           time.Duration
+	PrePublishPeriod time.Duration
+	// OwnIssuer serves the keys under the separate issuer <externalUrl>/keyrings/<name> instead of the shared JWKS
+	OwnIssuer bool
+}
+
+func (c *KeyRingConfig) FillWithDefaults(keyOpts KeyOpts) {
+	if c.Path == "" {
+		c.Path = "keyrings/" + c.Name
+	}
+	if c.RotationPeriod == 0 {
+		c.RotationPeriod = keyOpts.RotationPeriod
+	}
+	if c.RotationSchedule == "" {
+		c.RotationSchedule = keyOpts.RotationSchedule
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = keyOpts.MaxAge
+	}
+	if c.PrePublishPeriod == 0 {
+		c.PrePublishPeriod = keyOpts.PrePublish
+	}
+}
+
+func (c KeyRingConfig) Validate() error {
+	if !keyRingNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("name must only contain letters, digits, - and _")
+	}
+	if c.Path == defaultKeyLocation || c.Path == "lock" || c.Path == historyLocation || strings.HasPrefix(c.Path, historyLocation+"/") {
+		return fmt.Errorf("path %s is reserved", c.Path)
+	}
+	if c.PrePublishPeriod < 0 || c.PrePublishPeriod >= c.RotationPeriod {
+		return fmt.Errorf("prePublishPeriod must not be negative and must be smaller than rotationPeriod")
+	}
+	if c.MaxAge <= c.RotationPeriod+c.PrePublishPeriod {
+		return fmt.Errorf("maxAge must be larger than rotationPeriod + prePublishPeriod")
+	}
+	if _, err := ParseRotationSchedule(c.RotationSchedule); err != nil {
+		return fmt.Errorf("invalid rotationSchedule: %w", err)
+	}
+	return nil
+}
+
+// ParseRotationSchedule parses a cron expression (optionally prefixed with CRON_TZ=<zone>) that limits when keys are rotated.
+// Returns nil if schedule is empty.
+func ParseRotationSchedule(schedule string) (cron.Schedule, error) {
+	if schedule == "" {
+		return nil, nil
+	}
+	return cron.ParseStandard(schedule)
+}
+
+// RefreshHint returns how often relying parties should refresh the keys of the key ring. It is a tenth of the rotation period,
+// but at most half of the pre-publish period, so new keys are known before they are used for signing.
+func (c KeyRingConfig) RefreshHint() time.Duration {
+	hint := c.RotationPeriod / 10
+	if c.PrePublishPeriod > 0 && c.PrePublishPeriod/2 < hint {
+		hint = c.PrePublishPeriod / 2
+	}
+	return hint
+}
+
+// Issuer returns the issuer of tokens signed with this key ring
+func (c KeyRingConfig) Issuer(externalURL string) string {
+	if c.OwnIssuer {
+		return externalURL + "/keyrings/" + c.Name
+	}
+	return externalURL
+}
+
+func (c KeyRingConfig) String() string {
+	if c.Name == DefaultKeyRing {
+		return "default key ring"
+	}
+	return "key ring " + c.Name
+}
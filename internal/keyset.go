@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// KeyLifecycle records when a signing key reaches the phases of its lifecycle. Timestamps may be in the future for scheduled transitions.
+// Zero values mean that the transition has not been scheduled yet.
+type KeyLifecycle struct {
+	Created   time.Time `json:"created"`
+	Activated time.Time `json:"activated,omitzero"`
+	Retired   time.Time `json:"retired,omitzero"`
+	Removed   time.Time `json:"removed,omitzero"`
+	// Imported is set for keys that have not been generated by KeyManager
+	Imported bool `json:"imported,omitempty"`
+	// PinnedUntil prevents the scheduled rotation of the key before this time
+	PinnedUntil time.Time `json:"pinnedUntil,omitzero"`
+}
+
+// ManagedKey is a signing key together with its lifecycle metadata
+type ManagedKey struct {
+	JWK       jose.JSONWebKey `json:"jwk"`
+	Lifecycle KeyLifecycle    `json:"lifecycle"`
+}
+
+// KeySet is the set of all signing keys managed by KeyManager
+type KeySet []ManagedKey
+
+func (k *ManagedKey) UnmarshalJSON(data []byte) error {
+	type plainManagedKey ManagedKey
+	var plain plainManagedKey
+	err := json.Unmarshal(data, &plain)
+	if err != nil {
+		return err
+	}
+
+	if plain.JWK.Key == nil {
+		// legacy format: a plain JWK without lifecycle metadata
+		*k = ManagedKey{}
+		return k.JWK.UnmarshalJSON(data)
+	}
+
+	*k = ManagedKey(plain)
+	return nil
+}
+
+// IsActive returns whether the key is used for signing at the given time
+func (k ManagedKey) IsActive(now time.Time) bool {
+	return !k.Lifecycle.Activated.IsZero() && !now.Before(k.Lifecycle.Activated) && !k.IsRetired(now)
+}
+
+// IsUpcoming returns whether the key is already published, but not yet used for signing at the given time
+func (k ManagedKey) IsUpcoming(now time.Time) bool {
+	return !k.Lifecycle.Activated.IsZero() && now.Before(k.Lifecycle.Activated) && !k.IsRetired(now)
+}
+
+// IsRetired returns whether the key is no longer used for signing at the given time
+func (k ManagedKey) IsRetired(now time.Time) bool {
+	return !k.Lifecycle.Retired.IsZero() && !now.Before(k.Lifecycle.Retired)
+}
+
+// IsRemoved returns whether the key should no longer be part of the JWKS
+func (k ManagedKey) IsRemoved(now time.Time) bool {
+	return !k.Lifecycle.Removed.IsZero() && !now.Before(k.Lifecycle.Removed)
+}
+
+// Status returns whether the key is upcoming, active or retired at the given time
+func (k ManagedKey) Status(now time.Time) string {
+	switch {
+	case k.IsRetired(now):
+		return "retired"
+	case k.IsActive(now):
+		return "active"
+	case k.IsUpcoming(now):
+		return "upcoming"
+	default:
+		return "inactive"
+	}
+}
+
+// ActiveKey returns the index of the active key for the given algorithm, or -1 if there is none
+func (s KeySet) ActiveKey(algorithm string, now time.Time) int {
+	return s.findNewest(func(key ManagedKey) bool {
+		return key.JWK.Algorithm == algorithm && key.IsActive(now)
+	})
+}
+
+// UpcomingKey returns the index of the published, but not yet active key for the given algorithm, or -1 if there is none
+func (s KeySet) UpcomingKey(algorithm string, now time.Time) int {
+	return s.findNewest(func(key ManagedKey) bool {
+		return key.JWK.Algorithm == algorithm && key.IsUpcoming(now)
+	})
+}
+
+// findNewest returns the index of the most recently activated key matching the filter, or -1
+func (s KeySet) findNewest(filter func(key ManagedKey) bool) int {
+	newest := -1
+	for i, key := range s {
+		if filter(key) && (newest == -1 || key.Lifecycle.Activated.After(s[newest].Lifecycle.Activated)) {
+			newest = i
+		}
+	}
+	return newest
+}
+
+// PublicJWKS returns the public parts of all keys that have not been removed
+func (s KeySet) PublicJWKS(now time.Time) jose.JSONWebKeySet {
+	jwks := jose.JSONWebKeySet{
+		Keys: make([]jose.JSONWebKey, 0, len(s)),
+	}
+	for _, key := range s {
+		if !key.IsRemoved(now) {
+			jwks.Keys = append(jwks.Keys, key.JWK.Public())
+		}
+	}
+	return jwks
+}
+
+// thumbprint returns the base64url-encoded RFC 7638 SHA-256 thumbprint of the public part of the key
+func thumbprint(key jose.JSONWebKey) (string, error) {
+	pubKey := key.Public()
+	sum, err := pubKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sum), nil
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// Migration copies the signing keys (and optionally the issued tokens) from one storage-backend to another
+type Migration struct {
+	Source      Storage
+	Destination Storage
+	// KeyLocations are the storage locations of all key rings to migrate
+	KeyLocations []string
+	// Tokens whose currently issued tokens should be copied. If empty, only the keys are migrated
+	Tokens []TokenConfig
+	DryRun bool
+	// Force allows overwriting signing keys that already exist at the destination
+	Force bool
+}
+
+func (m Migration) Run(ctx context.Context) error {
+	migrated := 0
+	for _, location := range m.KeyLocations {
+		count, err := m.migrateKeys(ctx, location)
+		if err != nil {
+			return fmt.Errorf("error when migrating keys at %s: %w", location, err)
+		}
+		migrated += count
+	}
+	if migrated == 0 {
+		return ErrNoKeysFound
+	}
+
+	err := m.migrateKeyHistories(ctx)
+	if err != nil {
+		return fmt.Errorf("error when migrating key histories: %w", err)
+	}
+
+	for _, t := range m.Tokens {
+		token, err := m.Source.ReadToken(ctx, t)
+		if err == ErrTokenNotFound {
+			log.Printf("No token found for %s, skipping", t)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error when reading token %s from source: %w", t, err)
+		}
+		log.Printf("Migrating token %s", t)
+		if m.DryRun {
+			continue
+		}
+		err = m.Destination.WriteToken(ctx, t, token)
+		if err != nil {
+			return fmt.Errorf("error when writing token %s to destination: %w", t, err)
+		}
+	}
+
+	if m.DryRun {
+		log.Println("Dry run, nothing has been written")
+	}
+	return nil
+}
+
+// migrateKeys copies the keys stored at location and verifies the copy. Returns the number of migrated keys.
+func (m Migration) migrateKeys(ctx context.Context, location string) (int, error) {
+	keys, _, err := m.Source.GetKeys(ctx, location)
+	if err != nil && err != ErrNoKeysFound {
+		return 0, fmt.Errorf("error when reading keys from source: %w", err)
+	}
+	if len(keys) == 0 {
+		log.Printf("No signing keys found at %s, skipping", location)
+		return 0, nil
+	}
+
+	sourceThumbprints, err := keySetThumbprints(keys)
+	if err != nil {
+		return 0, err
+	}
+
+	existingKeys, destVersion, err := m.Destination.GetKeys(ctx, location)
+	if err != nil && err != ErrNoKeysFound {
+		return 0, fmt.Errorf("error when reading keys from destination: %w", err)
+	}
+	if len(existingKeys) > 0 && !m.Force {
+		return 0, fmt.Errorf("destination already contains %d signing keys, refusing to overwrite them", len(existingKeys))
+	}
+
+	for i, key := range keys {
+		log.Printf("Migrating signing key %s at %s (thumbprint %s)", key.JWK.KeyID, location, sourceThumbprints[i])
+	}
+
+	if m.DryRun {
+		return len(keys), nil
+	}
+
+	err = m.Destination.StoreKeys(ctx, location, keys, destVersion)
+	if err != nil {
+		return 0, fmt.Errorf("error when storing keys at destination: %w", err)
+	}
+	return len(keys), m.verify(ctx, location, sourceThumbprints)
+}
+
+// migrateKeyHistories copies the histories of all keys that do not have a history at the destination yet
+func (m Migration) migrateKeyHistories(ctx context.Context) error {
+	kids, err := m.Source.ListKeyHistories(ctx)
+	if err != nil {
+		return err
+	}
+	existing, err := m.Destination.ListKeyHistories(ctx)
+	if err != nil {
+		return err
+	}
+	for _, kid := range kids {
+		if slices.Contains(existing, kid) {
+			log.Printf("History of signing key %s already exists at destination, skipping", kid)
+			continue
+		}
+		history, err := m.Source.GetKeyHistory(ctx, kid)
+		if err != nil {
+			return err
+		}
+		log.Printf("Migrating history of signing key %s (%d events)", kid, len(history.Events))
+		if m.DryRun {
+			continue
+		}
+		err = m.Destination.AppendKeyEvents(ctx, history)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks that the destination now stores exactly the same keys at location as the source
+func (m Migration) verify(ctx context.Context, location string, sourceThumbprints []string) error {
+	migratedKeys, _, err := m.Destination.GetKeys(ctx, location)
+	if err != nil {
+		return fmt.Errorf("error when reading back migrated keys: %w", err)
+	}
+	destThumbprints, err := keySetThumbprints(migratedKeys)
+	if err != nil {
+		return err
+	}
+
+	slices.Sort(sourceThumbprints)
+	slices.Sort(destThumbprints)
+	if !slices.Equal(sourceThumbprints, destThumbprints) {
+		return fmt.Errorf("verification failed: JWKS thumbprints of source %v and destination %v differ", sourceThumbprints, destThumbprints)
+	}
+
+	log.Printf("Verified %d migrated signing keys at %s", len(destThumbprints), location)
+	return nil
+}
+
+// keySetThumbprints returns the RFC 7638 thumbprints of the public parts of the given keys, in the same order
+func keySetThumbprints(keys KeySet) ([]string, error) {
+	thumbprints := make([]string, len(keys))
+	for i, key := range keys {
+		var err error
+		thumbprints[i], err = thumbprint(key.JWK)
+		if err != nil {
+			return nil, fmt.Errorf("error when calculating thumbprint of key %s: %w", key.JWK.KeyID, err)
+		}
+	}
+	return thumbprints, nil
+}
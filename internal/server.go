@@ -1,8 +1,15 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"net/http"
+	"slices"
+	"time"
 
 	"github.com/go-jose/go-jose/v4"
 )
@@ -13,49 +20,171 @@ type JWKSServer struct {
 	externalURL string
 }
 
-func NewJWKSServer(store Storage, externalURL string) JWKSServer {
+// NewJWKSServer creates a server for the shared JWKS, which contains the keys of all key rings without their own issuer.
+// The keys are also served as PEM and as SPIFFE trust bundle. Key rings with their own issuer are served under /keyrings/<name>.
+func NewJWKSServer(store Storage, externalURL string, keyRings []KeyRingConfig) JWKSServer {
 	s := JWKSServer{
 		ServeMux:    http.NewServeMux(),
 		store:       store,
 		externalURL: externalURL,
 	}
 
-	s.Handle("/.well-known/openid-configuration", http.HandlerFunc(s.serveDiscovery))
-	s.Handle("/keys", http.HandlerFunc(s.serveKeys))
+	sharedLocations := make([]string, 0, len(keyRings))
+	var sharedRefreshHint time.Duration
+	for _, keyRing := range keyRings {
+		if keyRing.OwnIssuer {
+			s.registerKeys("/keyrings/"+keyRing.Name, keyRing.Issuer(externalURL), []string{keyRing.Path}, keyRing.RefreshHint())
+			continue
+		}
+		sharedLocations = append(sharedLocations, keyRing.Path)
+		if sharedRefreshHint == 0 || keyRing.RefreshHint() < sharedRefreshHint {
+			sharedRefreshHint = keyRing.RefreshHint()
+		}
+	}
+	s.registerKeys("", externalURL, sharedLocations, sharedRefreshHint)
 
 	return s
 }
 
-func (s JWKSServer) serveDiscovery(writer http.ResponseWriter, request *http.Request) {
-	resp := struct {
-		Issuer  string `json:"issuer"`
-		JWKSUri string `json:"jwks_uri"`
-	}{
-		Issuer:  s.externalURL,
-		JWKSUri: s.externalURL + "/keys",
-	}
+// registerKeys registers the discovery document and all representations of the keys stored at the given locations under prefix
+func (s JWKSServer) registerKeys(prefix string, issuer string, locations []string, refreshHint time.Duration) {
+	s.Handle(prefix+"/.well-known/openid-configuration", s.discoveryHandler(issuer))
+	s.Handle(prefix+"/keys", s.keysHandler(locations))
+	s.Handle(prefix+"/keys.pem", s.pemHandler(locations))
+	s.Handle(prefix+"/spiffe-bundle", s.spiffeBundleHandler(locations, refreshHint))
+}
 
-	writer.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(writer).Encode(resp)
+func (s JWKSServer) discoveryHandler(issuer string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		resp := struct {
+			Issuer  string `json:"issuer"`
+			JWKSUri string `json:"jwks_uri"`
+		}{
+			Issuer:  issuer,
+			JWKSUri: issuer + "/keys",
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(resp)
+	}
 }
 
-func (s JWKSServer) serveKeys(writer http.ResponseWriter, request *http.Request) {
-	jwks, err := s.store.GetKeys(request.Context())
+// keySnapshot returns the public keys stored at the given locations as one JWKS, together with the sum of the versions of the locations.
+// All representations of the keys are built from publishedKeys.
+func (s JWKSServer) keySnapshot(ctx context.Context, locations []string) (jose.JSONWebKeySet, int64, error) {
+	keys, sequence, err := s.publishedKeys(ctx, locations)
 	if err != nil {
-		http.Error(writer, err.Error(), 500)
-		return
+		return jose.JSONWebKeySet{}, 0, err
 	}
+	return keys.PublicJWKS(time.Now()), sequence, nil
+}
+
+// publishedKeys returns the keys stored at the given locations that have not been removed, together with the sum of the versions of the locations
+func (s JWKSServer) publishedKeys(ctx context.Context, locations []string) (KeySet, int64, error) {
+	now := time.Now()
+	published := KeySet{}
+	var sequence int64
+	for _, location := range locations {
+		keys, version, err := s.store.GetKeys(ctx, location)
+		if err != nil && err != ErrNoKeysFound {
+			return nil, 0, err
+		}
+		for _, key := range keys {
+			if !key.IsRemoved(now) {
+				published = append(published, key)
+			}
+		}
+		sequence += version
+	}
+	return published, sequence, nil
+}
+
+// keysHandler serves the public keys stored at the given locations as one JWKS
+func (s JWKSServer) keysHandler(locations []string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		pubKeys, _, err := s.keySnapshot(request.Context(), locations)
+		if err != nil {
+			http.Error(writer, err.Error(), 500)
+			return
+		}
 
-	pubKeys := jose.JSONWebKeySet{
-		Keys: make([]jose.JSONWebKey, len(jwks.Keys)),
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(pubKeys)
 	}
-	for i, key := range jwks.Keys {
-		pubKey := key.Public()
-		pubKeys.Keys[i] = pubKey
+}
+
+// pemHandler serves the public keys stored at the given locations as PEM-encoded PKIX public keys, each preceded by its kid, algorithm and status.
+// Only the keys currently used for signing are served, unless another status or all is selected with ?status=.
+func (s JWKSServer) pemHandler(locations []string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		statusFilter := request.URL.Query().Get("status")
+		if statusFilter == "" {
+			statusFilter = "active"
+		}
+		if !slices.Contains([]string{"active", "upcoming", "retired", "all"}, statusFilter) {
+			http.Error(writer, "status must be one of active, upcoming, retired or all", http.StatusBadRequest)
+			return
+		}
+		keys, _, err := s.publishedKeys(request.Context(), locations)
+		if err != nil {
+			http.Error(writer, err.Error(), 500)
+			return
+		}
+		now := time.Now()
+
+		var out bytes.Buffer
+		for _, key := range keys {
+			status := key.Status(now)
+			if statusFilter != "all" && status != statusFilter {
+				continue
+			}
+			der, err := x509.MarshalPKIXPublicKey(key.JWK.Public().Key)
+			if err != nil {
+				http.Error(writer, err.Error(), 500)
+				return
+			}
+			fmt.Fprintf(&out, "# kid: %s, alg: %s, status: %s\n", key.JWK.KeyID, key.JWK.Algorithm, status)
+			pem.Encode(&out, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		}
+
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		writer.Write(out.Bytes())
 	}
+}
 
-	writer.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(writer).Encode(pubKeys)
+// spiffeBundle is a SPIFFE trust bundle in JWKS format
+type spiffeBundle struct {
+	Keys        []jose.JSONWebKey `json:"keys"`
+	Sequence    int64             `json:"spiffe_sequence"`
+	RefreshHint int64             `json:"spiffe_refresh_hint"`
+}
+
+// spiffeBundleHandler serves the public keys stored at the given locations as SPIFFE trust bundle for JWT-SVIDs
+func (s JWKSServer) spiffeBundleHandler(locations []string, refreshHint time.Duration) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		pubKeys, sequence, err := s.keySnapshot(request.Context(), locations)
+		if err != nil {
+			http.Error(writer, err.Error(), 500)
+			return
+		}
+
+		bundle := spiffeBundle{
+			Keys:        make([]jose.JSONWebKey, len(pubKeys.Keys)),
+			Sequence:    sequence,
+			RefreshHint: int64(refreshHint.Seconds()),
+		}
+		for i, key := range pubKeys.Keys {
+			bundle.Keys[i] = jose.JSONWebKey{
+				Key:       key.Key,
+				KeyID:     key.KeyID,
+				Algorithm: key.Algorithm,
+				Use:       "jwt-svid",
+			}
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(bundle)
+	}
 }
 
 func (s JWKSServer) ListenAndServe(addr string) {
@@ -5,22 +5,41 @@ import (
 	"errors"
 	"log"
 	"time"
-
-	"github.com/go-jose/go-jose/v4"
 )
 
 var ErrTokenNotFound = errors.New("no stored token found for pipeline")
 var ErrNoKeysFound = errors.New("could not find existing signing keys")
+var ErrKeysVersionConflict = errors.New("stored signing keys have been modified concurrently")
+
+// TokenWriter is a destination for newly issued tokens
+type TokenWriter interface {
+	WriteToken(ctx context.Context, t TokenConfig, token string) error
+}
 
 type Storage interface {
+	TokenWriter
 	ReadToken(ctx context.Context, t TokenConfig) (string, error)
-	WriteToken(ctx context.Context, t TokenConfig, token string) error
 
-	StoreKeys(ctx context.Context, key jose.JSONWebKeySet) error
-	GetKeys(ctx context.Context) (jose.JSONWebKeySet, error)
+	// StoreKeys overwrites the keys stored at location, but only if the stored version still matches the given version.
+	// Returns ErrKeysVersionConflict otherwise. Version 0 means that no keys must have been stored yet. The stored keys get version + 1.
+	// Every key ring has its own location.
+	StoreKeys(ctx context.Context, location string, keys KeySet, version int64) error
+	// GetKeys returns the keys stored at location and their current version
+	GetKeys(ctx context.Context, location string) (KeySet, int64, error)
+
+	// AppendKeyEvents appends the events of history to the stored history of the key, which is created if it does not exist yet.
+	// Recorded events are never modified or deleted.
+	AppendKeyEvents(ctx context.Context, history KeyHistory) error
+	// GetKeyHistory returns the history of the key with the given kid, or ErrKeyHistoryNotFound
+	GetKeyHistory(ctx context.Context, kid string) (KeyHistory, error)
+	// ListKeyHistories returns the kids of all keys with a history
+	ListKeyHistories(ctx context.Context) ([]string, error)
 
 	Lock(ctx context.Context, name string, duration time.Duration) error
 	ReleaseLock(ctx context.Context) error
+
+	// CheckHealth checks if the backend is reachable and allows all operations required to manage the given tokens and key locations
+	CheckHealth(ctx context.Context, tokens []TokenConfig, keyLocations []string) error
 }
 
 // AquireLockAndHold tries to aquire the lock of the backend. Blocks until is has the lock.
@@ -3,17 +3,22 @@ package internal
 import (
 	"context"
 	"log"
+	"slices"
+	"sync"
 	"time"
-
-	"github.com/go-jose/go-jose/v4"
 )
 
 type Dummy struct {
-	tokens map[string]string
-	jwks   jose.JSONWebKeySet
+	tokens      map[string]string
+	keys        map[string]KeySet
+	keysVersion map[string]int64
+	history     map[string]KeyHistory
+	lock        sync.Mutex
 }
 
 func (o *Dummy) WriteToken(_ context.Context, t TokenConfig, token string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
 
 	if o.tokens == nil {
 		o.tokens = make(map[string]string)
@@ -25,6 +30,8 @@ func (o *Dummy) WriteToken(_ context.Context, t TokenConfig, token string) error
 }
 
 func (o *Dummy) ReadToken(_ context.Context, t TokenConfig) (string, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
 	if o.tokens != nil {
 		if token, exists := o.tokens[t.String()]; exists {
 			return token, nil
@@ -33,21 +40,59 @@ func (o *Dummy) ReadToken(_ context.Context, t TokenConfig) (string, error) {
 	return "", ErrTokenNotFound
 }
 
-func (o *Dummy) StoreKeys(ctx context.Context, keys jose.JSONWebKeySet) error {
-	if o.jwks.Keys == nil {
-		o.jwks = jose.JSONWebKeySet{
-			Keys: make([]jose.JSONWebKey, 1),
-		}
+func (o *Dummy) StoreKeys(ctx context.Context, location string, keys KeySet, version int64) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.keys == nil {
+		o.keys = make(map[string]KeySet)
+		o.keysVersion = make(map[string]int64)
+	}
+	if version != o.keysVersion[location] {
+		return ErrKeysVersionConflict
+	}
+	o.keys[location] = slices.Clone(keys)
+	o.keysVersion[location]++
+	return nil
+}
+
+func (o *Dummy) GetKeys(ctx context.Context, location string) (KeySet, int64, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return slices.Clone(o.keys[location]), o.keysVersion[location], nil
+}
+
+func (o *Dummy) AppendKeyEvents(ctx context.Context, history KeyHistory) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.history == nil {
+		o.history = make(map[string]KeyHistory)
+	}
+	existing, exists := o.history[history.JWK.KeyID]
+	if exists {
+		history.Events = append(slices.Clone(existing.Events), history.Events...)
 	}
-	o.jwks = keys
+	o.history[history.JWK.KeyID] = history
 	return nil
 }
 
-func (o *Dummy) GetKeys(ctx context.Context) (jose.JSONWebKeySet, error) {
-	if o.jwks.Keys == nil {
-		return jose.JSONWebKeySet{}, nil
+func (o *Dummy) GetKeyHistory(ctx context.Context, kid string) (KeyHistory, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	history, exists := o.history[kid]
+	if !exists {
+		return KeyHistory{}, ErrKeyHistoryNotFound
+	}
+	return history, nil
+}
+
+func (o *Dummy) ListKeyHistories(ctx context.Context) ([]string, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	kids := make([]string, 0, len(o.history))
+	for kid := range o.history {
+		kids = append(kids, kid)
 	}
-	return o.jwks, nil
+	return kids, nil
 }
 
 func (o *Dummy) Lock(ctx context.Context, name string, duration time.Duration) error {
@@ -57,3 +102,7 @@ func (o *Dummy) Lock(ctx context.Context, name string, duration time.Duration) e
 func (o *Dummy) ReleaseLock(ctx context.Context) error {
 	return nil
 }
+
+func (o *Dummy) CheckHealth(ctx context.Context, tokens []TokenConfig, keyLocations []string) error {
+	return nil
+}
@@ -3,13 +3,13 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"path"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-jose/go-jose/v4"
 	"github.com/hashicorp/vault-client-go"
 	"github.com/hashicorp/vault-client-go/schema"
 )
@@ -54,52 +54,140 @@ func (v Vault) ReadToken(ctx context.Context, t TokenConfig) (string, error) {
 	return secret.Data.Data["value"].(string), nil
 }
 
-func (v Vault) StoreKeys(ctx context.Context, keys jose.JSONWebKeySet) error {
+func (v Vault) StoreKeys(ctx context.Context, location string, keys KeySet, version int64) error {
 	data := make(map[string]interface{})
 
-	for _, key := range keys.Keys {
+	for _, key := range keys {
 		encoded, err := json.Marshal(key)
 		if err != nil {
 			return err
 		}
-		data[key.KeyID] = string(encoded)
+		data[key.JWK.KeyID] = string(encoded)
 	}
 
 	mountpoint, basepath := splitPath(v.ConfigPath)
-	targetPath := path.Join(basepath, "keys")
+	targetPath := path.Join(basepath, location)
 
 	_, err := v.VaultClient.Secrets.KvV2Write(ctx, targetPath, schema.KvV2WriteRequest{
+		Options: map[string]interface{}{
+			"cas": version,
+		},
 		Data: data,
 	},
 		vault.WithMountPath(mountpoint),
 	)
+	if err != nil && isCASError(err) {
+		return ErrKeysVersionConflict
+	}
 
 	return err
 }
 
-func (v Vault) GetKeys(ctx context.Context) (jose.JSONWebKeySet, error) {
+func (v Vault) GetKeys(ctx context.Context, location string) (KeySet, int64, error) {
 	mountpoint, basepath := splitPath(v.ConfigPath)
-	targetPath := path.Join(basepath, "keys")
+	targetPath := path.Join(basepath, location)
 
 	keys, err := v.VaultClient.Secrets.KvV2Read(ctx, targetPath, vault.WithMountPath(mountpoint))
 	if err != nil {
 		if strings.Contains(err.Error(), "Not Found") {
-			return jose.JSONWebKeySet{}, ErrNoKeysFound
+			return nil, 0, ErrNoKeysFound
 		}
-		return jose.JSONWebKeySet{}, err
+		return nil, 0, err
 	}
-	jsonWebKeys := make([]jose.JSONWebKey, len(keys.Data.Data))
+	managedKeys := make(KeySet, len(keys.Data.Data))
 	i := 0
 	for _, key := range keys.Data.Data {
-		err = json.Unmarshal([]byte(key.(string)), &jsonWebKeys[i])
+		err = json.Unmarshal([]byte(key.(string)), &managedKeys[i])
 		if err != nil {
-			return jose.JSONWebKeySet{}, err
+			return nil, 0, err
 		}
 		i += 1
 	}
-	return jose.JSONWebKeySet{
-		Keys: jsonWebKeys,
-	}, nil
+	version, _ := keys.Data.Metadata["version"].(json.Number)
+	versionInt, _ := version.Int64()
+	return managedKeys, versionInt, nil
+}
+
+func (v Vault) AppendKeyEvents(ctx context.Context, history KeyHistory) error {
+	for attempt := 1; ; attempt++ {
+		existing, version, err := v.readKeyHistory(ctx, history.JWK.KeyID)
+		if err != nil && err != ErrKeyHistoryNotFound {
+			return err
+		}
+		updated := history
+		if err == nil {
+			updated.Events = append(existing.Events, history.Events...)
+		}
+		encoded, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+
+		mountpoint, basepath := splitPath(v.ConfigPath)
+		targetPath := path.Join(basepath, historyLocation, historyName(history.JWK.KeyID))
+		_, err = v.VaultClient.Secrets.KvV2Write(ctx, targetPath, schema.KvV2WriteRequest{
+			Options: map[string]interface{}{
+				"cas": version,
+			},
+			Data: map[string]interface{}{
+				"value": string(encoded),
+			}},
+			vault.WithMountPath(mountpoint),
+		)
+		if err != nil && isCASError(err) && attempt < maxConflictRetries {
+			continue
+		}
+		return err
+	}
+}
+
+func (v Vault) GetKeyHistory(ctx context.Context, kid string) (KeyHistory, error) {
+	history, _, err := v.readKeyHistory(ctx, kid)
+	return history, err
+}
+
+// readKeyHistory returns the history of the key with the given kid and its version
+func (v Vault) readKeyHistory(ctx context.Context, kid string) (KeyHistory, int64, error) {
+	mountpoint, basepath := splitPath(v.ConfigPath)
+	targetPath := path.Join(basepath, historyLocation, historyName(kid))
+
+	secret, err := v.VaultClient.Secrets.KvV2Read(ctx, targetPath, vault.WithMountPath(mountpoint))
+	if err != nil {
+		if strings.Contains(err.Error(), "Not Found") {
+			return KeyHistory{}, 0, ErrKeyHistoryNotFound
+		}
+		return KeyHistory{}, 0, err
+	}
+	var history KeyHistory
+	encoded, _ := secret.Data.Data["value"].(string)
+	err = json.Unmarshal([]byte(encoded), &history)
+	if err != nil {
+		return KeyHistory{}, 0, fmt.Errorf("history of key %s is corrupt: %w", kid, err)
+	}
+	version, _ := secret.Data.Metadata["version"].(json.Number)
+	versionInt, _ := version.Int64()
+	return history, versionInt, nil
+}
+
+func (v Vault) ListKeyHistories(ctx context.Context) ([]string, error) {
+	mountpoint, basepath := splitPath(v.ConfigPath)
+	targetPath := path.Join(basepath, historyLocation)
+
+	list, err := v.VaultClient.Secrets.KvV2List(ctx, targetPath, vault.WithMountPath(mountpoint))
+	if err != nil {
+		if strings.Contains(err.Error(), "Not Found") {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	kids := make([]string, len(list.Data.Keys))
+	for i, name := range list.Data.Keys {
+		kids[i], err = historyKeyID(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return kids, nil
 }
 
 func (v Vault) Lock(ctx context.Context, name string, duration time.Duration) error {
@@ -183,13 +271,100 @@ func (v Vault) ReleaseLock(ctx context.Context) error {
 	return err
 }
 
+func (v Vault) CheckHealth(ctx context.Context, tokens []TokenConfig, keyLocations []string) error {
+	sealStatus, err := v.VaultClient.System.SealStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("error when checking seal-status: %w", err)
+	}
+	if sealStatus.Data.Sealed {
+		return fmt.Errorf("vault is sealed")
+	}
+
+	_, err = v.VaultClient.Auth.TokenLookUpSelf(ctx)
+	if err != nil {
+		return fmt.Errorf("vault token is invalid: %w", err)
+	}
+
+	configMount, configBase := splitPath(v.ConfigPath)
+	required := map[string][]string{
+		path.Join(configMount, "data", configBase, "lock"):     {"read", "create|update"},
+		path.Join(configMount, "metadata", configBase, "lock"): {"delete"},
+	}
+	for _, location := range keyLocations {
+		required[path.Join(configMount, "data", configBase, location)] = []string{"read", "create|update"}
+	}
+	// capabilities can only be queried for exact paths, so the histories of the current keys are checked, which are written on their next change
+	for _, location := range keyLocations {
+		keys, _, err := v.GetKeys(ctx, location)
+		if err != nil && err != ErrNoKeysFound {
+			return fmt.Errorf("error when reading keys at %s: %w", location, err)
+		}
+		for _, key := range keys {
+			required[path.Join(configMount, "data", configBase, historyLocation, historyName(key.JWK.KeyID))] = []string{"read", "create|update"}
+		}
+	}
+	required[path.Join(configMount, "metadata", configBase, historyLocation)] = []string{"list"}
+	concourseMount, concourseBase := splitPath(v.ConcoursePath)
+	for _, t := range tokens {
+		required[path.Join(concourseMount, "data", concourseBase, t.Team, t.Pipeline, t.Path)] = []string{"read", "create|update"}
+	}
+
+	paths := make([]string, 0, len(required))
+	for p := range required {
+		paths = append(paths, p)
+	}
+	resp, err := v.VaultClient.System.QueryTokenSelfCapabilities(ctx, schema.QueryTokenSelfCapabilitiesRequest{
+		Paths: paths,
+	})
+	if err != nil {
+		return fmt.Errorf("error when checking capabilities: %w", err)
+	}
+
+	for p, requiredCapabilities := range required {
+		granted, _ := resp.Data[p].([]interface{})
+		for _, capability := range requiredCapabilities {
+			if !hasCapability(granted, strings.Split(capability, "|")) {
+				return fmt.Errorf("missing capability %s on %s", capability, p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasCapability checks if any of the wanted capabilities has been granted
+func hasCapability(granted []interface{}, anyOf []string) bool {
+	for _, g := range granted {
+		capability, _ := g.(string)
+		if capability == "root" {
+			return true
+		}
+		for _, wanted := range anyOf {
+			if capability == wanted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isCASError(err error) bool {
+	return strings.Contains(err.Error(), "check-and-set parameter did not match")
+}
+
+// defaultKvMount is the mount vault-client-go uses for KV v2 requests without mount path
+const defaultKvMount = "kv-v2"
+
+// splitPath splits spath into the mount and the path within the mount. If spath has no mount (e.g. because it starts with a /),
+// the mount is defaultKvMount, which is used by the KV v2 requests in that case.
 func splitPath(spath string) (string, string) {
 	parts := strings.SplitN(spath, "/", 2)
-	switch len(parts) {
-	case 2:
-		return parts[0], parts[1]
-	case 1:
-		return parts[0], ""
+	mount, base := parts[0], ""
+	if len(parts) == 2 {
+		base = parts[1]
+	}
+	if mount == "" {
+		mount = defaultKvMount
 	}
-	return "", ""
+	return mount, base
 }
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// registeredClaims are the registered claims set by TokenGenerator
+var registeredClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"}
+
+// reservedClaims are set by TokenGenerator and can not be overridden by custom claims
+var reservedClaims = append(slices.Clone(registeredClaims), "team", "pipeline")
+
+// claimTemplateFuncs are the functions available in templated claims
+var claimTemplateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.ReplaceAll,
+}
+
+// ClaimTemplateData is passed to the templates of custom claims
+type ClaimTemplateData struct {
+	Team     string
+	Pipeline string
+	Path     string
+	KeyRing  string
+	Issuer   string
+	// Vars are the global claimVariables
+	Vars map[string]string
+}
+
+// mergeClaims returns the claims in defaults, overridden by the claims in claims
+func mergeClaims(defaults map[string]interface{}, claims map[string]interface{}) map[string]interface{} {
+	if len(defaults) == 0 {
+		return claims
+	}
+	merged := maps.Clone(defaults)
+	maps.Copy(merged, claims)
+	return merged
+}
+
+// validateClaims checks that no reserved claim is overridden and that all templates can be parsed
+func validateClaims(claims map[string]interface{}) error {
+	for name, value := range claims {
+		if slices.Contains(reservedClaims, name) {
+			return fmt.Errorf("claim %s is reserved and can not be overridden", name)
+		}
+		if _, err := renderClaim(name, value, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderClaims evaluates the templates in the values of all claims. Values can be strings, numbers, booleans or lists and maps of them.
+func renderClaims(claims map[string]interface{}, data ClaimTemplateData) (map[string]interface{}, error) {
+	rendered := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		var err error
+		rendered[name], err = renderClaim(name, value, &data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+// renderClaim evaluates all templates in value. If data is nil, the templates are only parsed.
+func renderClaim(name string, value interface{}, data *ClaimTemplateData) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		if !strings.Contains(value, "{{") {
+			return value, nil
+		}
+		tmpl, err := template.New(name).Funcs(claimTemplateFuncs).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for claim %s: %w", name, err)
+		}
+		if data == nil {
+			return value, nil
+		}
+		var rendered bytes.Buffer
+		err = tmpl.Execute(&rendered, data)
+		if err != nil {
+			return nil, fmt.Errorf("error when evaluating template for claim %s: %w", name, err)
+		}
+		return rendered.String(), nil
+	case []interface{}:
+		rendered := make([]interface{}, len(value))
+		for i, item := range value {
+			var err error
+			rendered[i], err = renderClaim(name, item, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rendered, nil
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			var err error
+			rendered[key], err = renderClaim(name+"."+key, item, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rendered, nil
+	default:
+		return value, nil
+	}
+}
@@ -21,6 +21,19 @@ type TokenConfig struct {
 	ExpiresIn    time.Duration
 	RenewBefore  time.Duration
 	Path         string
+	Hooks        []HookConfig
+	// SigningAlgorithm selects the key the token is signed with. Defaults to key.algorithm
+	SigningAlgorithm string
+	// KeyRing selects the key ring the token is signed with. Defaults to the key ring of the team, or the default key ring
+	KeyRing string
+	// SubjectFormat is a template (see SubjectTemplateData) or preset for the subject. Overrides SubjectScope. Defaults to subject.format
+	SubjectFormat string
+	// SubjectMaxLength is the maximum length of the subject in bytes. Defaults to subject.maxLength
+	SubjectMaxLength int
+	// Profile adapts the token to a cloud provider, see TokenProfiles
+	Profile string
+	// Claims are added to the token. String values may be templates, see ClaimTemplateData
+	Claims map[string]interface{}
 }
 
 var DefaultTokenConfig = TokenConfig{
@@ -32,13 +45,24 @@ var DefaultTokenConfig = TokenConfig{
 	Path:         "token",
 }
 
-func (c *TokenConfig) FillWithDefaults() {
+func (c *TokenConfig) FillWithDefaults(subjectOpts SubjectOpts) {
+	c.applyProfile()
 	if c.Team == "" {
 		c.Team = DefaultTokenConfig.Team
 	}
 	if c.SubjectScope == TokenSubjectScopeNone {
 		c.SubjectScope = DefaultTokenConfig.SubjectScope
 	}
+	if c.SubjectFormat == "" {
+		c.SubjectFormat = subjectOpts.Format
+	}
+	if c.SubjectFormat == "" {
+		c.SubjectFormat = c.profileSubjectFormat()
+	}
+	c.SubjectFormat = expandSubjectFormat(c.SubjectFormat, c.SubjectScope, subjectOpts.TrustDomain)
+	if c.SubjectMaxLength == 0 {
+		c.SubjectMaxLength = subjectOpts.MaxLength
+	}
 	if c.ExpiresIn == 0 {
 		c.ExpiresIn = DefaultTokenConfig.ExpiresIn
 	}
@@ -48,17 +72,40 @@ func (c *TokenConfig) FillWithDefaults() {
 	if c.Path == "" {
 		c.Path = DefaultTokenConfig.Path
 	}
+	for i := range c.Hooks {
+		c.Hooks[i].FillWithDefaults()
+	}
 }
 
+// Subject returns the subject of the token. The SubjectFormat must have been validated with Validate.
 func (c TokenConfig) Subject() string {
+	subject, _ := c.subject()
+	return subject
+}
+
+func (c TokenConfig) subject() (string, error) {
+	if c.SubjectFormat != "" {
+		return c.renderSubject()
+	}
 	switch c.SubjectScope {
 	case TokenSubjectScopeTeam:
-		return c.Team
+		return c.Team, nil
 	case TokenSubjectScopePipeline:
-		return c.Team + "/" + c.Pipeline
+		return c.Team + "/" + c.Pipeline, nil
 	default:
-		return ""
+		return "", nil
+	}
+}
 
+// claimTemplateData returns the data the templates of the custom claims are evaluated with
+func (c TokenConfig) claimTemplateData(issuer string, vars map[string]string) ClaimTemplateData {
+	return ClaimTemplateData{
+		Team:     c.Team,
+		Pipeline: c.Pipeline,
+		Path:     c.Path,
+		KeyRing:  c.KeyRing,
+		Issuer:   issuer,
+		Vars:     vars,
 	}
 }
 
@@ -76,5 +123,20 @@ func (c TokenConfig) Validate() error {
 	if c.RenewBefore >= c.ExpiresIn {
 		return fmt.Errorf("renewBefore must be smaller than expiresIn")
 	}
+	subject, err := c.subject()
+	if err != nil {
+		return err
+	}
+	if err := validateSubject(subject, c.SubjectMaxLength); err != nil {
+		return err
+	}
+	if err := validateClaims(c.Claims); err != nil {
+		return err
+	}
+	for _, hook := range c.Hooks {
+		if err := hook.Validate(); err != nil {
+			return fmt.Errorf("invalid hook: %w", err)
+		}
+	}
 	return nil
 }
@@ -1,46 +1,138 @@
 package internal
 
 import (
+	"crypto"
 	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"math"
 	"math/big"
+	"reflect"
+	"slices"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/cryptosigner"
 	"github.com/go-jose/go-jose/v4/jwt"
 )
 
-// TokenGenerator generates signed tokens from TokenConfigs using it's key.
-// TokenGenerator is safe for concurrent use (including changes of the signing-key)
+// supportedSignatureAlgorithms are all algorithms tokens may be signed with
+var supportedSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512, jose.PS256,
+	jose.ES256, jose.ES384,
+	jose.EdDSA,
+}
+
+// SigningKey is a key tokens are signed with. The private key may be held by a KeyBackend and only be accessible through Signer.
+type SigningKey struct {
+	// JWK is the public key
+	JWK    jose.JSONWebKey
+	Signer crypto.Signer
+}
+
+// opaqueSigner returns a signer for go-jose that sets the kid of the key in the header of signed tokens
+func (k SigningKey) opaqueSigner() jose.OpaqueSigner {
+	return keyIDSigner{
+		OpaqueSigner: cryptosigner.Opaque(k.Signer),
+		public:       k.JWK,
+	}
+}
+
+// keyIDSigner overrides the public key of an OpaqueSigner, which is used for the kid header
+type keyIDSigner struct {
+	jose.OpaqueSigner
+	public jose.JSONWebKey
+}
+
+func (s keyIDSigner) Public() *jose.JSONWebKey {
+	return &s.public
+}
+
+// TokenGenerator generates signed tokens from TokenConfigs. It holds one active key per algorithm for every key ring.
+// TokenGenerator is safe for concurrent use (including changes of the signing-keys)
 type TokenGenerator struct {
-	issuer string
-	key    jose.JSONWebKey
-	lock   sync.RWMutex
+	issuer           string
+	defaultAlgorithm string
+	// keys maps each key ring to the active key per algorithm
+	keys map[string]map[string]SigningKey
+	// issuers overrides the issuer for key rings with their own issuer
+	issuers map[string]string
+	// published maps each key ring to the public keys in its JWKS by kid
+	published map[string]map[string]jose.JSONWebKey
+	// removals maps each key ring to the scheduled removal from the JWKS per kid
+	removals map[string]map[string]time.Time
+	// claimVariables are available in the templates of custom claims
+	claimVariables map[string]string
+	lock           sync.RWMutex
+}
+
+// NewTokenGenerator creates a TokenGenerator that signs tokens without a configured SigningAlgorithm using defaultAlgorithm
+func NewTokenGenerator(issuer string, defaultAlgorithm string) *TokenGenerator {
+	return &TokenGenerator{
+		issuer:           issuer,
+		defaultAlgorithm: defaultAlgorithm,
+		keys:             make(map[string]map[string]SigningKey),
+		issuers:          make(map[string]string),
+		published:        make(map[string]map[string]jose.JSONWebKey),
+		removals:         make(map[string]map[string]time.Time),
+	}
+}
+
+// SetIssuer sets the issuer of tokens signed with the given key ring
+func (g *TokenGenerator) SetIssuer(keyRing string, issuer string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.issuers[keyRing] = issuer
+}
+
+// SetClaimVariables sets the variables that are available in the templates of custom claims
+func (g *TokenGenerator) SetClaimVariables(vars map[string]string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.claimVariables = vars
 }
 
-func NewTokenGenerator(issuer string, key *jose.JSONWebKey) *TokenGenerator {
-	gen := &TokenGenerator{
-		issuer: issuer,
+// issuerFor returns the issuer of tokens signed with the given key ring. Must be called while holding the lock.
+func (g *TokenGenerator) issuerFor(keyRing string) string {
+	if issuer, exists := g.issuers[keyRing]; exists {
+		return issuer
 	}
-	if key != nil {
-		gen.key = *key
+	return g.issuer
+}
+
+// signingKey returns the key to use for the given TokenConfig. Must be called while holding the lock.
+func (g *TokenGenerator) signingKey(conf TokenConfig) (SigningKey, error) {
+	algorithm := conf.SigningAlgorithm
+	if algorithm == "" {
+		algorithm = g.defaultAlgorithm
+	}
+	key, exists := g.keys[conf.KeyRing][algorithm]
+	if !exists {
+		if conf.KeyRing != DefaultKeyRing {
+			return SigningKey{}, fmt.Errorf("no signing key available for algorithm %s in key ring %s", algorithm, conf.KeyRing)
+		}
+		return SigningKey{}, fmt.Errorf("no signing key available for algorithm %s", algorithm)
 	}
-	return gen
+	return key, nil
 }
 
 func (g *TokenGenerator) Generate(conf TokenConfig) (token string, validUntil time.Time, err error) {
 	g.lock.RLock()
 	defer g.lock.RUnlock()
 
+	key, err := g.signingKey(conf)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
 	now := time.Now()
 	validUntil = now.Add(conf.ExpiresIn)
 
 	signingKey := jose.SigningKey{
-		Algorithm: jose.SignatureAlgorithm(g.key.Algorithm),
-		Key:       g.key,
+		Algorithm: jose.SignatureAlgorithm(key.JWK.Algorithm),
+		Key:       key.opaqueSigner(),
 	}
 
 	signer, err := jose.NewSigner(signingKey, &jose.SignerOptions{})
@@ -48,8 +140,14 @@ func (g *TokenGenerator) Generate(conf TokenConfig) (token string, validUntil ti
 		return "", time.Time{}, err
 	}
 
+	issuer := g.issuerFor(conf.KeyRing)
+	extraClaims, err := renderClaims(conf.Claims, conf.claimTemplateData(issuer, g.claimVariables))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
 	claims := jwt.Claims{
-		Issuer:    g.issuer,
+		Issuer:    issuer,
 		IssuedAt:  jwt.NewNumericDate(now),
 		NotBefore: jwt.NewNumericDate(now),
 		Audience:  jwt.Audience(conf.Audience),
@@ -66,7 +164,7 @@ func (g *TokenGenerator) Generate(conf TokenConfig) (token string, validUntil ti
 		Pipeline: conf.Pipeline,
 	}
 
-	signed, err := jwt.Signed(signer).Claims(claims).Claims(customClaims).Serialize()
+	signed, err := jwt.Signed(signer).Claims(extraClaims).Claims(claims).Claims(customClaims).Serialize()
 	if err != nil {
 		return "", time.Time{}, err
 	}
@@ -74,31 +172,185 @@ func (g *TokenGenerator) Generate(conf TokenConfig) (token string, validUntil ti
 	return signed, validUntil, nil
 }
 
-func (g *TokenGenerator) IsTokenStillValid(token string) (bool, time.Time, error) {
+// TokenValidity is the result of verifying a stored token against the published keys of its key ring
+type TokenValidity struct {
+	// Valid is set if the token has been signed by a published key with the algorithm of the TokenConfig and has not yet expired
+	Valid bool
+	// Reason explains why the token is not valid
+	Reason string
+	KeyID  string
+	// ExpiresAt is the expiry of the token
+	ExpiresAt time.Time
+	// Remaining is the lifetime left until ExpiresAt
+	Remaining time.Duration
+}
+
+// VerifyToken verifies the token against all keys of its key ring that are published in the JWKS, not only against the current key.
+// Returns an error only if the token can not be parsed.
+func (g *TokenGenerator) VerifyToken(conf TokenConfig, token string) (TokenValidity, error) {
 	g.lock.RLock()
 	defer g.lock.RUnlock()
 
-	parsed, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{jose.SignatureAlgorithm(g.key.Algorithm)})
+	parsed, err := jwt.ParseSigned(token, supportedSignatureAlgorithms)
 	if err != nil {
-		return false, time.Time{}, err
+		return TokenValidity{}, err
+	}
+	validity := TokenValidity{
+		KeyID: parsed.Headers[0].KeyID,
+	}
+
+	key, published := g.published[conf.KeyRing][validity.KeyID]
+	if !published {
+		validity.Reason = fmt.Sprintf("key %s is not published", validity.KeyID)
+		return validity, nil
+	}
+	algorithm := conf.SigningAlgorithm
+	if algorithm == "" {
+		algorithm = g.defaultAlgorithm
+	}
+	if key.Algorithm != algorithm {
+		validity.Reason = fmt.Sprintf("token is signed with %s instead of %s", key.Algorithm, algorithm)
+		return validity, nil
 	}
 
 	claims := jwt.Claims{}
-	err = parsed.Claims(g.key, &claims)
+	allClaims := make(map[string]interface{})
+	err = parsed.Claims(key.Key, &claims, &allClaims)
 	if err != nil {
-		if strings.Contains(err.Error(), "expired") {
-			return false, time.Time{}, nil
+		validity.Reason = fmt.Sprintf("invalid signature: %s", err)
+		return validity, nil
+	}
+	if claims.Expiry == nil {
+		validity.Reason = "token has no exp claim"
+		return validity, nil
+	}
+	validity.ExpiresAt = claims.Expiry.Time()
+	validity.Remaining = time.Until(validity.ExpiresAt)
+	if validity.Remaining <= 0 {
+		validity.Reason = "token has expired"
+		return validity, nil
+	}
+
+	if drift := g.configDrift(conf, claims, allClaims); drift != "" {
+		validity.Reason = "the token config has changed: " + drift
+		return validity, nil
+	}
+
+	validity.Valid = true
+	return validity, nil
+}
+
+// configDrift compares the claims of a token with the claims Generate would issue for the TokenConfig now, and describes the first difference.
+// Returns an empty string if there is no difference. Must be called while holding the lock.
+func (g *TokenGenerator) configDrift(conf TokenConfig, claims jwt.Claims, allClaims map[string]interface{}) string {
+	if issuer := g.issuerFor(conf.KeyRing); claims.Issuer != issuer {
+		return fmt.Sprintf("issuer changed from %s to %s", claims.Issuer, issuer)
+	}
+	if subject := conf.Subject(); claims.Subject != subject {
+		return fmt.Sprintf("subject changed from %s to %s", claims.Subject, subject)
+	}
+	if !slices.Equal(claims.Audience, conf.Audience) {
+		return fmt.Sprintf("audience changed from %v to %v", []string(claims.Audience), conf.Audience)
+	}
+	if claims.IssuedAt == nil {
+		return "token has no iat claim"
+	}
+	// both claims are truncated to seconds
+	expiresIn := claims.Expiry.Time().Sub(claims.IssuedAt.Time())
+	if (expiresIn - conf.ExpiresIn).Abs() >= time.Second {
+		return fmt.Sprintf("expiresIn changed from %s to %s", expiresIn, conf.ExpiresIn)
+	}
+
+	expected, err := renderClaims(conf.Claims, conf.claimTemplateData(g.issuerFor(conf.KeyRing), g.claimVariables))
+	if err != nil {
+		return err.Error()
+	}
+	expected["team"] = conf.Team
+	expected["pipeline"] = conf.Pipeline
+	// normalize the expected claims to the types of decoded JSON
+	encoded, err := json.Marshal(expected)
+	if err != nil {
+		return err.Error()
+	}
+	expected = make(map[string]interface{})
+	if err := json.Unmarshal(encoded, &expected); err != nil {
+		return err.Error()
+	}
+	for name, value := range allClaims {
+		if slices.Contains(registeredClaims, name) {
+			continue
+		}
+		if _, exists := expected[name]; !exists {
+			return fmt.Sprintf("claim %s has been removed", name)
+		}
+		if !reflect.DeepEqual(value, expected[name]) {
+			return fmt.Sprintf("claim %s changed from %v to %v", name, value, expected[name])
+		}
+	}
+	for name := range expected {
+		if _, exists := allClaims[name]; !exists {
+			return fmt.Sprintf("claim %s has been added", name)
 		}
-		return false, time.Time{}, err
 	}
+	return ""
+}
 
-	return true, claims.Expiry.Time(), nil
+// CurrentKeyID returns the kid of the key new tokens for the given TokenConfig are signed with
+func (g *TokenGenerator) CurrentKeyID(conf TokenConfig) (string, error) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	key, err := g.signingKey(conf)
+	if err != nil {
+		return "", err
+	}
+	return key.JWK.KeyID, nil
 }
 
-func (g *TokenGenerator) SetKey(key jose.JSONWebKey) {
+// SetKeys replaces the keys of the given key ring. keys maps each algorithm to its active signing key
+func (g *TokenGenerator) SetKeys(keyRing string, keys map[string]SigningKey) {
 	g.lock.Lock()
 	defer g.lock.Unlock()
-	g.key = key
+	g.keys[keyRing] = keys
+}
+
+// SetPublishedKeys replaces the public keys of the given key ring that are published in the JWKS
+func (g *TokenGenerator) SetPublishedKeys(keyRing string, keys []jose.JSONWebKey) {
+	published := make(map[string]jose.JSONWebKey, len(keys))
+	for _, key := range keys {
+		published[key.KeyID] = key
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.published[keyRing] = published
+}
+
+// SetScheduledRemovals replaces the scheduled removals of the keys of the given key ring. removals maps kids to the time
+// the key is removed from the JWKS
+func (g *TokenGenerator) SetScheduledRemovals(keyRing string, removals map[string]time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.removals[keyRing] = removals
+}
+
+// KeyRemovalTime returns when the key with the given kid is removed from the JWKS, if its removal has been scheduled
+func (g *TokenGenerator) KeyRemovalTime(kid string) (time.Time, bool) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	for _, removals := range g.removals {
+		if removal, exists := removals[kid]; exists {
+			return removal, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// tokenKeyID returns the kid from the header of the token, or an empty string if the token can not be parsed
+func tokenKeyID(token string) string {
+	parsed, err := jwt.ParseSigned(token, supportedSignatureAlgorithms)
+	if err != nil || len(parsed.Headers) == 0 {
+		return ""
+	}
+	return parsed.Headers[0].KeyID
 }
 
 func generateJTI() string {
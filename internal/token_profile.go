@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// TokenProfile adapts tokens to the requirements of a cloud provider or other consumer
+type TokenProfile struct {
+	// Audience is used for tokens without audience. If empty, the audience must be configured.
+	Audience []string
+	// SingleAudience requires the token to have exactly one audience
+	SingleAudience bool
+	// SubjectFormats are the subject formats per subject scope, used if neither the token config nor subject.format set one
+	SubjectFormats map[TokenSubjectScope]string
+	// MaxSubjectLength limits the length of the subject in bytes
+	MaxSubjectLength int
+	// MaxExpiresIn limits the lifetime of the token. 0 disables the limit
+	MaxExpiresIn time.Duration
+	// Algorithms are the accepted signing algorithms. If empty, all algorithms are accepted
+	Algorithms []string
+	// Claims are added to the token, unless they are configured otherwise
+	Claims map[string]interface{}
+}
+
+// qualifiedSubjectFormats name every part of the subject, so trust policies can match on prefixes like team:main:*
+var qualifiedSubjectFormats = map[TokenSubjectScope]string{
+	TokenSubjectScopeTeam:     "team:{{ .Team }}",
+	TokenSubjectScopePipeline: "team:{{ .Team }}:pipeline:{{ .Pipeline }}",
+}
+
+// TokenProfiles are the profiles that can be selected with TokenConfig.Profile
+var TokenProfiles = map[string]TokenProfile{
+	// AssumeRoleWithWebIdentity. The audience must be registered as client ID of the IAM OIDC provider.
+	// Team and pipeline are passed as session tags, so they can be used as aws:PrincipalTag/team and aws:PrincipalTag/pipeline.
+	"aws": {
+		Audience:         []string{"sts.amazonaws.com"},
+		SubjectFormats:   qualifiedSubjectFormats,
+		MaxSubjectLength: 255,
+		Algorithms:       []string{"RS256", "RS384", "RS512", "ES256", "ES384"},
+		Claims: map[string]interface{}{
+			"https://aws.amazon.com/tags": map[string]interface{}{
+				"principal_tags": map[string]interface{}{
+					"team":     []interface{}{"{{ .Team }}"},
+					"pipeline": []interface{}{"{{ .Pipeline }}"},
+				},
+			},
+		},
+	},
+	// Workload Identity Federation. The audience is the full resource name of the workload identity pool provider,
+	// e.g. //iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>
+	// The claims can be mapped to attributes, e.g. attribute.team_pipeline=assertion.team_pipeline, and used in principalSet://.../attribute.team_pipeline/<team>/<pipeline>.
+	"gcp": {
+		SubjectFormats:   qualifiedSubjectFormats,
+		MaxSubjectLength: 127,
+		MaxExpiresIn:     24 * time.Hour,
+		Algorithms:       []string{"RS256", "ES256"},
+		Claims: map[string]interface{}{
+			"team_pipeline": "{{ .Team }}/{{ .Pipeline }}",
+		},
+	},
+	// Federated identity credentials of Microsoft Entra ID. The subject of the credential must match the subject of the token exactly,
+	// e.g. team:main:pipeline:deploy.
+	"azure": {
+		Audience:         []string{"api://AzureADTokenExchange"},
+		SingleAudience:   true,
+		SubjectFormats:   qualifiedSubjectFormats,
+		MaxSubjectLength: 600,
+		Algorithms:       []string{"RS256"},
+	},
+	// JWT auth method. The audience must be listed in the bound_audiences of the role.
+	"vault": {
+		Audience:         []string{"vault"},
+		SubjectFormats:   qualifiedSubjectFormats,
+		MaxSubjectLength: 255,
+	},
+}
+
+// profileNames returns the names of all TokenProfiles in alphabetical order
+func profileNames() []string {
+	names := make([]string, 0, len(TokenProfiles))
+	for name := range TokenProfiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// applyProfile fills the defaults of the profile of the token config
+func (c *TokenConfig) applyProfile() {
+	profile, exists := TokenProfiles[c.Profile]
+	if !exists {
+		return
+	}
+	if len(c.Audience) == 0 {
+		c.Audience = slices.Clone(profile.Audience)
+	}
+	if c.Path == "" {
+		c.Path = c.Profile + "-token"
+	}
+	if c.SubjectMaxLength == 0 {
+		c.SubjectMaxLength = profile.MaxSubjectLength
+	}
+	c.Claims = mergeClaims(profile.Claims, c.Claims)
+}
+
+// profileSubjectFormat returns the subject format of the profile for the subject scope of the token config, or an empty string
+func (c TokenConfig) profileSubjectFormat() string {
+	return TokenProfiles[c.Profile].SubjectFormats[c.SubjectScope]
+}
+
+// validateProfile checks that the token config meets the requirements of its profile. algorithm is the algorithm the token is signed with.
+func (c TokenConfig) validateProfile(algorithm string) error {
+	if c.Profile == "" {
+		return nil
+	}
+	profile, exists := TokenProfiles[c.Profile]
+	if !exists {
+		return fmt.Errorf("unknown profile %s, must be one of %v", c.Profile, profileNames())
+	}
+	if len(c.Audience) == 0 {
+		return fmt.Errorf("audience must be set for profile %s", c.Profile)
+	}
+	if profile.SingleAudience && len(c.Audience) != 1 {
+		return fmt.Errorf("profile %s requires exactly one audience", c.Profile)
+	}
+	if c.SubjectMaxLength == 0 || c.SubjectMaxLength > profile.MaxSubjectLength {
+		return fmt.Errorf("subjectMaxLength must be between 1 and %d for profile %s", profile.MaxSubjectLength, c.Profile)
+	}
+	if profile.MaxExpiresIn > 0 && c.ExpiresIn > profile.MaxExpiresIn {
+		return fmt.Errorf("expiresIn must not be larger than %s for profile %s", profile.MaxExpiresIn, c.Profile)
+	}
+	if len(profile.Algorithms) > 0 && !slices.Contains(profile.Algorithms, algorithm) {
+		return fmt.Errorf("signing algorithm %s is not supported by profile %s, must be one of %v", algorithm, c.Profile, profile.Algorithms)
+	}
+	return nil
+}
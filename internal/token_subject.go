@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// SubjectFormatSPIFFE is the preset for SPIFFE IDs: spiffe://<trust-domain>/concourse/<team>[/<pipeline>]
+const SubjectFormatSPIFFE = "spiffe"
+
+// maxSPIFFEIDLength is the maximum length of SPIFFE IDs, as recommended by the SPIFFE-ID specification
+const maxSPIFFEIDLength = 2048
+
+var (
+	spiffeTrustDomainPattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	spiffePathSegmentPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+// SubjectTemplateData is passed to the template of the subject format
+type SubjectTemplateData struct {
+	Team     string
+	Pipeline string
+	Path     string
+	KeyRing  string
+}
+
+// SubjectOpts are the defaults for the subjects of all tokens
+type SubjectOpts struct {
+	// Format is a template or preset for the subject. If empty, the subject is built according to the subjectScope
+	Format string
+	// MaxLength is the maximum length of subjects in bytes. 0 disables the limit
+	MaxLength int
+	// TrustDomain is the SPIFFE trust domain used by the spiffe preset
+	TrustDomain string
+}
+
+// expandSubjectFormat returns the template for the given format, replacing presets with their template
+func expandSubjectFormat(format string, scope TokenSubjectScope, trustDomain string) string {
+	if format != SubjectFormatSPIFFE {
+		return format
+	}
+	expanded := "spiffe://" + trustDomain + "/concourse/{{ .Team }}"
+	if scope == TokenSubjectScopePipeline {
+		expanded += "/{{ .Pipeline }}"
+	}
+	return expanded
+}
+
+// renderSubject evaluates the subject format of the token config
+func (c TokenConfig) renderSubject() (string, error) {
+	tmpl, err := template.New("subject").Funcs(claimTemplateFuncs).Parse(c.SubjectFormat)
+	if err != nil {
+		return "", fmt.Errorf("invalid subjectFormat: %w", err)
+	}
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, SubjectTemplateData{
+		Team:     c.Team,
+		Pipeline: c.Pipeline,
+		Path:     c.Path,
+		KeyRing:  c.KeyRing,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error when evaluating subjectFormat: %w", err)
+	}
+	return rendered.String(), nil
+}
+
+// validateSubject checks the length and the characters of the subject. SPIFFE IDs must additionally conform to the SPIFFE-ID specification.
+func validateSubject(subject string, maxLength int) error {
+	if subject == "" {
+		return fmt.Errorf("subject must not be empty")
+	}
+	if maxLength > 0 && len(subject) > maxLength {
+		return fmt.Errorf("subject %s is longer than %d bytes", subject, maxLength)
+	}
+	if i := strings.IndexFunc(subject, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }); i != -1 {
+		return fmt.Errorf("subject %q contains whitespace or non-printable characters", subject)
+	}
+	if strings.HasPrefix(subject, "spiffe://") {
+		return validateSPIFFEID(subject)
+	}
+	return nil
+}
+
+// validateSPIFFEID checks that id is a valid SPIFFE ID for a workload
+func validateSPIFFEID(id string) error {
+	if len(id) > maxSPIFFEIDLength {
+		return fmt.Errorf("SPIFFE ID %s is longer than %d bytes", id, maxSPIFFEIDLength)
+	}
+	parsed, err := url.Parse(id)
+	if err != nil {
+		return fmt.Errorf("invalid SPIFFE ID %s: %w", id, err)
+	}
+	if parsed.User != nil || parsed.Port() != "" || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.RawPath != "" {
+		return fmt.Errorf("invalid SPIFFE ID %s: must not contain user info, port, query, fragment or escaped characters", id)
+	}
+	if !spiffeTrustDomainPattern.MatchString(parsed.Host) {
+		return fmt.Errorf("invalid SPIFFE ID %s: trust domain must only contain lowercase letters, digits, dots, dashes and underscores", id)
+	}
+	if parsed.Path == "" {
+		return fmt.Errorf("invalid SPIFFE ID %s: path must not be empty", id)
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(parsed.Path, "/"), "/") {
+		if segment == "." || segment == ".." || !spiffePathSegmentPattern.MatchString(segment) {
+			return fmt.Errorf("invalid SPIFFE ID %s: path segments must not be empty, '.' or '..' and must only contain letters, digits, dots, dashes and underscores", id)
+		}
+	}
+	return nil
+}
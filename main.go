@@ -2,44 +2,146 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	cpidp "github.com/dbaumgarten/concourse-pipeline-idp/internal"
 	"github.com/hashicorp/vault-client-go"
+	flag "github.com/spf13/pflag"
 )
 
 func main() {
+	command := "serve"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 
 	cfg, err := cpidp.LoadConfig()
 	if err != nil {
 		log.Fatal("Error loading config: ", err)
 	}
 
-	err = cfg.Validate()
+	switch command {
+	case "serve":
+		serve(cfg)
+	case "migrate":
+		migrate(cfg)
+	case "backup", "restore":
+		backupCommand(cfg, command, flag.Args())
+	case "rotate", "retire", "revoke", "import":
+		adminCommand(cfg, command, flag.Args())
+	case "history", "verify":
+		historyCommand(cfg, command, flag.Args())
+	default:
+		log.Fatalf("Unknown command %s. Available commands: serve, migrate, backup, restore, rotate, retire, revoke, import, history, verify", command)
+	}
+}
+
+func serve(cfg cpidp.Config) {
+	err := cfg.Validate()
 	if err != nil {
 		log.Fatal("Config is invalid: ", err)
 	}
 
 	ctx := context.Background()
 
-	var out cpidp.Storage
-	switch cfg.Backend {
-	case "dev":
-		out = &cpidp.Dummy{}
-	case "vault":
-		out = getVaultStorage(cfg)
+	out := getStorage(cfg)
+	keyRings := cfg.AllKeyRings()
+
+	healthMonitor := &cpidp.HealthMonitor{
+		Storage:      out,
+		Tokens:       cfg.Tokens,
+		KeyLocations: cfg.KeyLocations(),
+		Interval:     cfg.HealthOpts.Interval,
 	}
+	go healthMonitor.Run(ctx)
 
+	server := cpidp.NewJWKSServer(out, cfg.ExternalURL, keyRings)
+	server.HandleFunc("/readyz", healthMonitor.ServeReady)
 	if cfg.ListenAddr != "" {
-		server := cpidp.NewJWKSServer(out, cfg.ExternalURL)
 		go server.ListenAndServe(cfg.ListenAddr)
 	}
 
+	tokenGenerator := cpidp.NewTokenGenerator(cfg.ExternalURL, cfg.KeyOpts.Algorithm)
+	tokenGenerator.SetClaimVariables(cfg.ClaimVariables)
+	for _, keyRing := range keyRings {
+		if keyRing.OwnIssuer {
+			tokenGenerator.SetIssuer(keyRing.Name, keyRing.Issuer(cfg.ExternalURL))
+		}
+	}
+
+	destinations := make([]cpidp.TokenWriter, len(cfg.Webhooks))
+	for i, webhookConfig := range cfg.Webhooks {
+		destinations[i], err = cpidp.NewWebhook(webhookConfig)
+		if err != nil {
+			log.Fatal("Error creating webhook: ", err)
+		}
+	}
+
+	ctl := &cpidp.Controller{
+		TokenGenerator:    tokenGenerator,
+		Storage:           out,
+		TokenConfigs:      cfg.Tokens,
+		Destinations:      destinations,
+		Hooks:             cfg.Hooks,
+		ReissueOnRotation: cfg.KeyOpts.ReissueOnRotation,
+		ReissueWindow:     cfg.KeyOpts.ReissueWindow,
+	}
+	server.HandleFunc("/status", ctl.ServeStatus)
+
+	var certificateIssuer *cpidp.CertificateIssuer
+	if cfg.KeyOpts.Certificates {
+		certificateIssuer, err = cpidp.LoadCertificateIssuer(cfg.KeyOpts.CACert, cfg.KeyOpts.CAKey)
+		if err != nil {
+			log.Fatal("Error loading key CA: ", err)
+		}
+	}
+
+	keyBackend, err := cpidp.NewKeyBackend(cfg)
+	if err != nil {
+		log.Fatal("Error creating key backend: ", err)
+	}
+
+	keyManagers := make([]*cpidp.KeyManager, len(keyRings))
+	for i, keyRing := range keyRings {
+		rotationSchedule, err := cpidp.ParseRotationSchedule(keyRing.RotationSchedule)
+		if err != nil {
+			log.Fatal("Invalid rotation schedule: ", err)
+		}
+		keyManagers[i] = &cpidp.KeyManager{
+			Storage:             out,
+			TokenGenerator:      tokenGenerator,
+			KeyRing:             keyRing.Name,
+			KeyLocation:         keyRing.Path,
+			KeyRotationPeriod:   keyRing.RotationPeriod,
+			KeyRotationSchedule: rotationSchedule,
+			KeyMaxAge:           keyRing.MaxAge,
+			KeyPrePublishPeriod: keyRing.PrePublishPeriod,
+			KeyAlgorithms:       cfg.KeyOpts.Algorithms,
+			KeyBits:             cfg.KeyOpts.RSABits,
+			Reissuer:            ctl,
+			CertificateIssuer:   certificateIssuer,
+			KeyBackend:          keyBackend,
+		}
+	}
+
+	adminAPI := &cpidp.AdminAPI{
+		KeyManagers: keyManagers,
+		Storage:     out,
+		Token:       cfg.AdminOpts.Token,
+	}
+	if cfg.AdminOpts.Token != "" {
+		adminAPI.Register(server.ServeMux)
+	}
+
 	if cfg.LeaderElectionOpts.Enabled {
 		log.Println("Trying to aquire leader lock")
 		err = cpidp.AquireLockAndHold(ctx, out, cfg.LeaderElectionOpts.Name, cfg.LeaderElectionOpts.TTL, time.Duration(float64(cfg.LeaderElectionOpts.TTL)*0.1))
@@ -53,42 +155,245 @@ func main() {
 		go func() {
 			<-c
 			log.Print("Releasing leader lock")
+			adminAPI.SetLeader(false)
 			out.ReleaseLock(ctx)
 			os.Exit(0)
 		}()
 	}
 
-	tokenGenerator := cpidp.NewTokenGenerator(cfg.ExternalURL, nil)
+	// Run the keyManagers once to make sure signing-keys exist and tokenGenerator is configured with a key for every key ring
+	for _, keyManager := range keyManagers {
+		_, err = keyManager.ManageOnce(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	adminAPI.SetLeader(true)
 
-	keyManager := cpidp.KeyManager{
-		Storage:           out,
-		TokenGenerator:    tokenGenerator,
-		KeyRotationPeriod: cfg.KeyOpts.RotationPeriod,
-		KeyMaxAge:         cfg.KeyOpts.MaxAge,
+	// run the keyManagers in background to periodically generate new keys
+	for _, keyManager := range keyManagers {
+		go keyManager.Manage(ctx)
 	}
 
-	// Run the keyManager once to make sure signing-keys exist and tokenGenerator is configured with a key
-	_, err = keyManager.ManageOnce(ctx)
+	err = ctl.Run(ctx)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Error starting controller", err)
+		os.Exit(1)
+	}
+}
+
+func migrate(cfg cpidp.Config) {
+	err := cfg.ValidateBackend()
+	if err != nil {
+		log.Fatal("Config is invalid: ", err)
+	}
+	if cfg.MigrateOpts.Destination == "" {
+		log.Fatal("migrate.destination must be set")
+	}
+
+	destCfg, err := cpidp.LoadBackendConfig(cfg.MigrateOpts.Destination)
+	if err != nil {
+		log.Fatal("Error loading destination config: ", err)
+	}
+	err = destCfg.ValidateBackend()
+	if err != nil {
+		log.Fatal("Destination config is invalid: ", err)
 	}
 
-	// run the keyManager in background to periodically generate new keys
-	go keyManager.Manage(ctx)
+	migration := cpidp.Migration{
+		Source:       getStorage(cfg),
+		Destination:  getStorage(destCfg),
+		KeyLocations: cfg.KeyLocations(),
+		DryRun:       cfg.MigrateOpts.DryRun,
+		Force:        cfg.MigrateOpts.Force,
+	}
+	if cfg.MigrateOpts.Tokens {
+		migration.Tokens = cfg.Tokens
+	}
 
-	ctl := cpidp.Controller{
-		TokenGenerator: tokenGenerator,
-		Storage:        out,
-		TokenConfigs:   cfg.Tokens,
+	err = migration.Run(context.Background())
+	if err != nil {
+		log.Fatal("Migration failed: ", err)
 	}
+}
 
-	err = ctl.Run(ctx)
+// backupCommand writes an encrypted backup of the signing keys to a file or restores it
+func backupCommand(cfg cpidp.Config, command string, args []string) {
+	err := cfg.ValidateBackend()
 	if err != nil {
-		fmt.Println("Error starting controller", err)
+		log.Fatal("Config is invalid: ", err)
+	}
+	if len(args) != 1 {
+		log.Fatalf("Usage: %s <backup-file>", command)
+	}
+
+	keyBackup := cpidp.KeyBackup{
+		Storage:      getStorage(cfg),
+		KeyLocations: cfg.KeyLocations(),
+		Passphrase:   cfg.BackupOpts.Passphrase,
+		Force:        cfg.BackupOpts.Force,
+	}
+	if cfg.BackupOpts.KeyFile != "" {
+		data, err := os.ReadFile(cfg.BackupOpts.KeyFile)
+		if err != nil {
+			log.Fatal("Error reading backup.keyFile: ", err)
+		}
+		keyBackup.Key, err = cpidp.ParseBackupKey(data)
+		if err != nil {
+			log.Fatal("Error parsing backup.keyFile: ", err)
+		}
+	}
+
+	ctx := context.Background()
+	if command == "backup" {
+		data, err := keyBackup.Backup(ctx)
+		if err != nil {
+			log.Fatal("Backup failed: ", err)
+		}
+		err = os.WriteFile(args[0], data, 0600)
+		if err != nil {
+			log.Fatal("Error writing backup: ", err)
+		}
+		log.Printf("Wrote backup to %s", args[0])
+		return
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		log.Fatal("Error reading backup: ", err)
+	}
+	err = keyBackup.Restore(ctx, data)
+	if err != nil {
+		log.Fatal("Restore failed: ", err)
+	}
+}
+
+// historyCommand prints the key history, or verifies a token against it. Both read the storage-backend directly.
+func historyCommand(cfg cpidp.Config, command string, args []string) {
+	err := cfg.ValidateBackend()
+	if err != nil {
+		log.Fatal("Config is invalid: ", err)
+	}
+	store := getStorage(cfg)
+	ctx := context.Background()
+	output := json.NewEncoder(os.Stdout)
+	output.SetIndent("", "  ")
+
+	if command == "history" {
+		if len(args) > 1 {
+			log.Fatal("Usage: history [kid]")
+		}
+		var histories []cpidp.KeyHistory
+		if len(args) == 1 {
+			if err := cpidp.ValidateKeyID(args[0]); err != nil {
+				log.Fatal(err)
+			}
+			var history cpidp.KeyHistory
+			history, err = store.GetKeyHistory(ctx, args[0])
+			histories = []cpidp.KeyHistory{history}
+		} else {
+			histories, err = cpidp.LoadKeyHistories(ctx, store)
+		}
+		if err != nil {
+			log.Fatal("Error reading key history: ", err)
+		}
+		output.Encode(histories)
+		return
+	}
+
+	if len(args) != 1 {
+		log.Fatal("Usage: verify <token-file|->")
+	}
+	var token []byte
+	if args[0] == "-" {
+		token, err = io.ReadAll(os.Stdin)
+	} else {
+		token, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		log.Fatal("Error reading token: ", err)
+	}
+	result, err := cpidp.VerifyWithKeyHistory(ctx, store, strings.TrimSpace(string(token)))
+	if err != nil {
+		log.Fatal("Error verifying token: ", err)
+	}
+	output.Encode(result)
+	if !result.Valid {
 		os.Exit(1)
 	}
 }
 
+// adminCommand performs a key operation through the admin api of the running leader
+func adminCommand(cfg cpidp.Config, command string, args []string) {
+	if cfg.AdminOpts.Token == "" {
+		log.Fatal("admin.token must be set")
+	}
+	client := cpidp.AdminClient{
+		URL:   cfg.AdminOpts.URL,
+		Token: cfg.AdminOpts.Token,
+	}
+	ctx := context.Background()
+
+	var message string
+	var err error
+	switch command {
+	case "rotate":
+		algorithm := ""
+		if len(args) > 0 {
+			algorithm = args[0]
+		}
+		message, err = client.Rotate(ctx, cfg.AdminOpts.KeyRing, algorithm)
+	case "retire", "revoke":
+		if len(args) != 1 {
+			log.Fatalf("Usage: %s <kid>", command)
+		}
+		if command == "retire" {
+			message, err = client.Retire(ctx, args[0])
+		} else {
+			message, err = client.Revoke(ctx, args[0])
+		}
+	case "import":
+		if len(args) != 1 {
+			log.Fatal("Usage: import <key-file>")
+		}
+		message, err = importKey(ctx, cfg, client, args[0])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(message)
+}
+
+func importKey(ctx context.Context, cfg cpidp.Config, client cpidp.AdminClient, file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	key, err := cpidp.ParsePrivateKey(data, cfg.ImportOpts.Algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	var pinnedUntil time.Time
+	if cfg.ImportOpts.PinnedUntil != "" {
+		pinnedUntil, err = time.Parse(time.RFC3339, cfg.ImportOpts.PinnedUntil)
+		if err != nil {
+			return "", fmt.Errorf("invalid import.pinUntil: %w", err)
+		}
+	}
+
+	return client.Import(ctx, cfg.AdminOpts.KeyRing, *key, pinnedUntil)
+}
+
+func getStorage(cfg cpidp.Config) cpidp.Storage {
+	switch cfg.Backend {
+	case "vault":
+		return getVaultStorage(cfg)
+	default:
+		return &cpidp.Dummy{}
+	}
+}
+
 func getVaultStorage(cfg cpidp.Config) cpidp.Storage {
 	vc, err := vault.New(
 		vault.WithAddress(cfg.VaultOpts.URL),